@@ -14,45 +14,115 @@
 	limitations under the License.
 */
 
-// Package certifier makes it easy to spin up a dns.DNS and an acme.ACME instance together
+// Package certifier makes it easy to spin up a dns.DNS, an acme.ACME, a renewal.Manager, and a sweeper.Sweeper instance together
 package certifier
 
 import (
+	"crypto/tls"
 	"github.com/loopholelabs/certifier/pkg/acme"
 	"github.com/loopholelabs/certifier/pkg/dns"
 	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/certifier/pkg/renewal"
+	"github.com/loopholelabs/certifier/pkg/sweeper"
+	"net"
+	"net/http"
 )
 
-// Certifier packages up a dns.DNS instance and an acme.ACME instance to make it easier to work with both of them
+// Certifier packages up a dns.DNS instance, an acme.ACME instance, a renewal.Manager instance,
+// and a sweeper.Sweeper instance to make it easier to work with all of them
 type Certifier struct {
 	// dns is the dns.DNS instance for this instance of Certifier
 	dns *dns.DNS
 
 	// acme is the acme.ACME instance for this instance of Certifier
 	acme *acme.ACME
+
+	// renewal is the renewal.Manager instance for this instance of Certifier
+	renewal *renewal.Manager
+
+	// sweeper is the sweeper.Sweeper instance for this instance of Certifier
+	sweeper *sweeper.Sweeper
 }
 
 // New creates a new instance of Certifier
 func New(root string, public string, opts ...options.Option) *Certifier {
 	d := dns.New(root, public, opts...)
-	a := acme.New(opts...)
+	// the root is appended without modifying the backing array of the given options
+	a := acme.New(append(opts[:len(opts):len(opts)], options.WithRoot(root))...)
+	r := renewal.New(a, opts...)
+	s := sweeper.New(opts...)
 	return &Certifier{
-		dns:  d,
-		acme: a,
+		dns:     d,
+		acme:    a,
+		renewal: r,
+		sweeper: s,
 	}
 }
 
-// Start starts an instance of Certifier given an address
+// Start starts an instance of Certifier given an address, along with its sweeper.Sweeper
 func (c *Certifier) Start(addr string) error {
+	c.sweeper.Start()
 	return c.dns.Start(addr)
 }
 
-// Shutdown shuts down an instance of Certifier
+// StartAsync starts an instance of Certifier given an address, returning as soon as the DNS server
+// is serving instead of blocking, after which any failures are sent to the channel returned by Errors
+func (c *Certifier) StartAsync(addr string) error {
+	c.sweeper.Start()
+	return c.dns.StartAsync(addr)
+}
+
+// Ready returns a channel that is closed once the DNS server of an instance of Certifier is serving
+func (c *Certifier) Ready() <-chan struct{} {
+	return c.dns.Ready()
+}
+
+// Errors returns a channel that receives the error that the DNS server of an
+// instance of Certifier fails with after it was started using StartAsync
+func (c *Certifier) Errors() <-chan error {
+	return c.dns.Errors()
+}
+
+// StartWithConns starts an instance of Certifier given a net.PacketConn and a net.Listener
+// that have already been bound, either of which can be nil (see dns.DNS.StartWithConns)
+func (c *Certifier) StartWithConns(packetConn net.PacketConn, listener net.Listener) error {
+	c.sweeper.Start()
+	return c.dns.StartWithConns(packetConn, listener)
+}
+
+// StartTLS starts a DNS-over-TLS server for an instance of Certifier given an address and a tls.Config,
+// which can be used alongside Start (see dns.DNS.StartTLS)
+func (c *Certifier) StartTLS(addr string, config *tls.Config) error {
+	c.sweeper.Start()
+	return c.dns.StartTLS(addr, config)
+}
+
+// DoHHandler returns an http.Handler that answers DNS-over-HTTPS queries for an instance of Certifier (see dns.DNS.DoHHandler)
+func (c *Certifier) DoHHandler() http.Handler {
+	return c.dns.DoHHandler()
+}
+
+// Shutdown shuts down an instance of Certifier, stopping any automatic renewals and sweeps and
+// canceling any in-progress certificate requests before shutting down the DNS server
 func (c *Certifier) Shutdown() error {
+	c.renewal.Stop()
+	c.sweeper.Stop()
+	c.acme.Shutdown()
 	return c.dns.Shutdown()
 }
 
+// DNS returns the dns.DNS instance for this instance of Certifier, which can be
+// used to find the addresses that its servers are bound to
+func (c *Certifier) DNS() *dns.DNS {
+	return c.dns
+}
+
 // ACME returns the acme.ACME instance for this instance of Certifier
 func (c *Certifier) ACME() *acme.ACME {
 	return c.acme
 }
+
+// Renewal returns the renewal.Manager instance for this instance of Certifier
+func (c *Certifier) Renewal() *renewal.Manager {
+	return c.renewal
+}
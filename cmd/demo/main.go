@@ -26,11 +26,10 @@ import (
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/loopholelabs/certifier"
 	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/keys"
 	"github.com/loopholelabs/certifier/pkg/options"
-	"github.com/loopholelabs/certifier/pkg/utils"
 	"github.com/loopholelabs/logging"
-	"os"
-	"time"
+	"strings"
 )
 
 const (
@@ -45,6 +44,7 @@ var (
 	directory string
 	email     string
 	domain    string
+	domains   []string
 )
 
 type User struct {
@@ -74,19 +74,20 @@ func main() {
 	flag.StringVar(&public, "public", "", "set the publicly resolvable domain that resolves to certifier")
 	flag.StringVar(&directory, "directory", "", "set the ACME directory URL")
 	flag.StringVar(&email, "email", "", "set the email for your ACME registration")
-	flag.StringVar(&domain, "domain", "", "set the domain to obtain a certificate for")
+	flag.StringVar(&domain, "domain", "", "set the domain to obtain a certificate for (multiple domains, including wildcards, can be separated by commas)")
 	flag.Parse()
 
+	domains = strings.Split(domain, ",")
+
 	if listen == "" || root == "" || public == "" || directory == "" || email == "" || domain == "" {
 		panic("all required command line args must be filled in: --listen, --root, --public, --directory, --email, --domain")
 	}
 
 	logger.Importantf("In order for this demo to work, you must have this instance of Certifier publicly available on port 53 and accessible on the domain '%s' (via an A record)\n", public)
 	logger.Importantf("You must also have an NS record for '%s' pointing to '%s'\n", root, public)
-	logger.Importantf("And finally, you must have a CNAME record for '_acme-challenge.%s' pointing to '%s.%s.%s'\n", domain, utils.NormalizeDomain(domain), CID, root)
-	logger.Importantf("Without these records, this demo will fail.\n")
 
-	c := certifier.New(root, public, options.WithLogger(logger), options.WithStorage(storage))
+	// the certificate private key is generated by certifier using the configured key type
+	c := certifier.New(root, public, options.WithLogger(logger), options.WithStorage(storage), options.WithKeyType(keys.EC256))
 
 	// normally you would use c.ACME().RegisterCID, but we want to use a hard-coded CID, not a randomly generated one so we are
 	// setting the value in storage manually
@@ -95,12 +96,16 @@ func main() {
 		panic(err)
 	}
 
-	clientPrivateKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		panic(err)
+	for _, d := range domains {
+		delegation, err := c.ACME().DelegationInstructions(userID, d)
+		if err != nil {
+			panic(err)
+		}
+		logger.Importantf("And finally, you must have a CNAME record for '%s' pointing to '%s'\n", delegation.Name, delegation.Target)
 	}
+	logger.Importantf("Without these records, this demo will fail.\n")
 
-	certificatePrivateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	clientPrivateKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
 		panic(err)
 	}
@@ -113,7 +118,7 @@ func main() {
 	acmeConfig := lego.NewConfig(acmeUser)
 
 	acmeConfig.CADirURL = directory
-	acmeConfig.Certificate.KeyType = certcrypto.RSA4096
+	acmeConfig.Certificate.KeyType = certcrypto.EC256
 
 	acmeClient, err := lego.NewClient(acmeConfig)
 	if err != nil {
@@ -127,22 +132,30 @@ func main() {
 
 	acmeUser.Registration = reg
 
+	// certificates can only be obtained once Certifier is answering DNS queries
+	if err := c.StartAsync(listen); err != nil {
+		panic(err)
+	}
 	go func() {
-		time.Sleep(time.Second * 2)
-		logger.Infof("Starting Cert Renewal, expecting TXT Record for for '_acme-challenge.%s' to point to '%s.%s.%s", domain, utils.NormalizeDomain(domain), CID, root)
-		cert, err := c.ACME().RenewDNS(userID, domain, acmeClient, certificatePrivateKey)
-		if err != nil {
+		if err := <-c.Errors(); err != nil {
 			panic(err)
 		}
-		logger.Infof("Certificate Contents: \n%s\n\n", cert.Certificate)
-		err = c.Shutdown()
+	}()
+
+	for _, d := range domains {
+		delegation, err := c.ACME().VerifyDelegation(userID, d)
 		if err != nil {
 			panic(err)
 		}
-		os.Exit(0)
-	}()
-
-	if err := c.Start(listen); err != nil {
+		logger.Infof("Starting Cert Renewal, CNAME record '%s' should point to '%s' and currently points to '%s' (%s)\n", delegation.Name, delegation.Target, delegation.Found, delegation.Status)
+	}
+	cert, err := c.ACME().RenewDNSDomains(userID, domains, acmeClient, nil)
+	if err != nil {
+		panic(err)
+	}
+	logger.Infof("Certificate Contents: \n%s\n\n", cert.Certificate)
+	err = c.Shutdown()
+	if err != nil {
 		panic(err)
 	}
 }
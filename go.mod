@@ -8,9 +8,11 @@ require (
 	github.com/go-acme/lego/v4 v4.17.4
 	github.com/google/uuid v1.6.0
 	github.com/loopholelabs/logging v0.1.2
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/miekg/dns v1.1.61
 	github.com/rs/zerolog v1.33.0
 	github.com/stretchr/testify v1.9.0
+	go.etcd.io/bbolt v1.3.11
 )
 
 require (
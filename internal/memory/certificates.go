@@ -0,0 +1,86 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package memory
+
+import (
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"sort"
+	"sync"
+)
+
+var _ storage.CertificateStorage = (*Certificates)(nil)
+
+type certificateKey struct {
+	id     string
+	domain string
+}
+
+type Certificates struct {
+	certificates   map[certificateKey]*storage.Certificate
+	certificatesMu sync.RWMutex
+}
+
+func NewCertificates() *Certificates {
+	return &Certificates{
+		certificates: make(map[certificateKey]*storage.Certificate),
+	}
+}
+
+func (c *Certificates) SetCertificate(certificate *storage.Certificate) error {
+	c.certificatesMu.Lock()
+	c.certificates[certificateKey{id: certificate.ID, domain: certificate.Domain}] = certificate.Copy()
+	c.certificatesMu.Unlock()
+	return nil
+}
+
+func (c *Certificates) GetCertificate(id string, domain string) (certificate *storage.Certificate, ok bool) {
+	c.certificatesMu.RLock()
+	certificate, ok = c.certificates[certificateKey{id: id, domain: domain}]
+	if ok {
+		certificate = certificate.Copy()
+	}
+	c.certificatesMu.RUnlock()
+	return
+}
+
+func (c *Certificates) ListCertificates() ([]*storage.Certificate, error) {
+	c.certificatesMu.RLock()
+	certificates := make([]*storage.Certificate, 0, len(c.certificates))
+	for _, certificate := range c.certificates {
+		certificates = append(certificates, certificate.Copy())
+	}
+	c.certificatesMu.RUnlock()
+	sort.Slice(certificates, func(i, j int) bool {
+		if certificates[i].ID == certificates[j].ID {
+			return certificates[i].Domain < certificates[j].Domain
+		}
+		return certificates[i].ID < certificates[j].ID
+	})
+	return certificates, nil
+}
+
+func (c *Certificates) RemoveCertificate(id string, domain string) error {
+	c.certificatesMu.Lock()
+	key := certificateKey{id: id, domain: domain}
+	if _, ok := c.certificates[key]; !ok {
+		c.certificatesMu.Unlock()
+		return storage.ErrNotFound
+	}
+	delete(c.certificates, key)
+	c.certificatesMu.Unlock()
+	return nil
+}
@@ -21,22 +21,41 @@ package memory
 import (
 	"github.com/loopholelabs/certifier/pkg/storage"
 	"github.com/loopholelabs/certifier/pkg/utils"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 var _ storage.Storage = (*Memory)(nil)
 
+type dnsChallenge struct {
+	challenge string
+	createdAt time.Time
+}
+
 type Memory struct {
-	cids            map[string]string
-	cidsMu          sync.RWMutex
-	dnsChallenges   map[string]string
-	dnsChallengesMu sync.RWMutex
+	cids             map[string]string
+	ids              map[string]map[string]struct{}
+	cidsMu           sync.RWMutex
+	retiredCIDs      map[string]storage.RetiredCID
+	retiredCIDsMu    sync.RWMutex
+	allowedDomains   map[string][]string
+	allowedDomainsMu sync.RWMutex
+	hashedLabels     map[string]string
+	hashedLabelsMu   sync.RWMutex
+	dnsChallenges    map[string][]dnsChallenge
+	dnsChallengesMu  sync.RWMutex
 }
 
 func New() *Memory {
 	return &Memory{
-		cids:          make(map[string]string),
-		dnsChallenges: make(map[string]string),
+		cids:           make(map[string]string),
+		ids:            make(map[string]map[string]struct{}),
+		retiredCIDs:    make(map[string]storage.RetiredCID),
+		allowedDomains: make(map[string][]string),
+		hashedLabels:   make(map[string]string),
+		dnsChallenges:  make(map[string][]dnsChallenge),
 	}
 }
 
@@ -47,6 +66,10 @@ func (m *Memory) SetCID(id string, cid string) error {
 		return storage.ErrAlreadyExists
 	}
 	m.cids[id] = cid
+	if m.ids[cid] == nil {
+		m.ids[cid] = make(map[string]struct{})
+	}
+	m.ids[cid][id] = struct{}{}
 	m.cidsMu.Unlock()
 	return nil
 }
@@ -60,46 +83,229 @@ func (m *Memory) GetCID(id string) (cid string, ok bool) {
 
 func (m *Memory) RemoveCID(id string) error {
 	m.cidsMu.Lock()
-	if _, ok := m.cids[id]; !ok {
+	cid, ok := m.cids[id]
+	if !ok {
 		m.cidsMu.Unlock()
 		return storage.ErrNotFound
 	}
 	delete(m.cids, id)
+	delete(m.ids[cid], id)
+	if len(m.ids[cid]) == 0 {
+		delete(m.ids, cid)
+	}
 	m.cidsMu.Unlock()
 	return nil
 }
 
-func (m *Memory) SetDNSChallenge(cid string, domain string, challenge string) error {
-	m.dnsChallengesMu.Lock()
-	key := appendDomainToCID(cid, domain)
-	if _, ok := m.dnsChallenges[key]; ok {
-		m.dnsChallengesMu.Unlock()
+func (m *Memory) GetID(cid string) (id string, ok bool) {
+	m.cidsMu.RLock()
+	for i := range m.ids[cid] {
+		if !ok || i < id {
+			id, ok = i, true
+		}
+	}
+	m.cidsMu.RUnlock()
+	return
+}
+
+func (m *Memory) ListCIDs(after string, limit int) ([]storage.Registration, error) {
+	m.cidsMu.RLock()
+	registrations := make([]storage.Registration, 0, len(m.cids))
+	for id, cid := range m.cids {
+		if id > after {
+			registrations = append(registrations, storage.Registration{ID: id, CID: cid})
+		}
+	}
+	m.cidsMu.RUnlock()
+
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].ID < registrations[j].ID
+	})
+	if limit > 0 && len(registrations) > limit {
+		registrations = registrations[:limit]
+	}
+	return registrations, nil
+}
+
+func (m *Memory) RetireCID(cid string, id string, until time.Time) error {
+	m.retiredCIDsMu.Lock()
+	if _, ok := m.retiredCIDs[cid]; ok {
+		m.retiredCIDsMu.Unlock()
 		return storage.ErrAlreadyExists
 	}
-	m.dnsChallenges[key] = challenge
+	m.retiredCIDs[cid] = storage.RetiredCID{CID: cid, ID: id, Until: until}
+	m.retiredCIDsMu.Unlock()
+	return nil
+}
+
+func (m *Memory) GetRetiredCID(cid string) (retired storage.RetiredCID, ok bool) {
+	m.retiredCIDsMu.RLock()
+	retired, ok = m.retiredCIDs[cid]
+	m.retiredCIDsMu.RUnlock()
+	return
+}
+
+func (m *Memory) RemoveRetiredCID(cid string) error {
+	m.retiredCIDsMu.Lock()
+	if _, ok := m.retiredCIDs[cid]; !ok {
+		m.retiredCIDsMu.Unlock()
+		return storage.ErrNotFound
+	}
+	delete(m.retiredCIDs, cid)
+	m.retiredCIDsMu.Unlock()
+	return nil
+}
+
+func (m *Memory) ListRetiredCIDs(after string, limit int) ([]storage.RetiredCID, error) {
+	m.retiredCIDsMu.RLock()
+	retired := make([]storage.RetiredCID, 0, len(m.retiredCIDs))
+	for cid, r := range m.retiredCIDs {
+		if cid > after {
+			retired = append(retired, r)
+		}
+	}
+	m.retiredCIDsMu.RUnlock()
+
+	sort.Slice(retired, func(i, j int) bool {
+		return retired[i].CID < retired[j].CID
+	})
+	if limit > 0 && len(retired) > limit {
+		retired = retired[:limit]
+	}
+	return retired, nil
+}
+
+func (m *Memory) SetAllowedDomains(id string, domains []string) error {
+	m.allowedDomainsMu.Lock()
+	m.allowedDomains[id] = append([]string(nil), domains...)
+	m.allowedDomainsMu.Unlock()
+	return nil
+}
+
+func (m *Memory) GetAllowedDomains(id string) (domains []string, ok bool) {
+	m.allowedDomainsMu.RLock()
+	domains, ok = m.allowedDomains[id]
+	domains = append([]string(nil), domains...)
+	m.allowedDomainsMu.RUnlock()
+	return
+}
+
+func (m *Memory) RemoveAllowedDomains(id string) error {
+	m.allowedDomainsMu.Lock()
+	if _, ok := m.allowedDomains[id]; !ok {
+		m.allowedDomainsMu.Unlock()
+		return storage.ErrNotFound
+	}
+	delete(m.allowedDomains, id)
+	m.allowedDomainsMu.Unlock()
+	return nil
+}
+
+func (m *Memory) SetHashedLabel(label string, domain string) error {
+	m.hashedLabelsMu.Lock()
+	m.hashedLabels[label] = domain
+	m.hashedLabelsMu.Unlock()
+	return nil
+}
+
+func (m *Memory) GetHashedLabel(label string) (domain string, ok bool) {
+	m.hashedLabelsMu.RLock()
+	domain, ok = m.hashedLabels[label]
+	m.hashedLabelsMu.RUnlock()
+	return
+}
+
+func (m *Memory) SetDNSChallenge(cid string, label string, challenge string) error {
+	m.dnsChallengesMu.Lock()
+	key := appendLabelToCID(cid, label)
+	for _, c := range m.dnsChallenges[key] {
+		if c.challenge == challenge {
+			m.dnsChallengesMu.Unlock()
+			return storage.ErrAlreadyExists
+		}
+	}
+	m.dnsChallenges[key] = append(m.dnsChallenges[key], dnsChallenge{challenge: challenge, createdAt: time.Now()})
 	m.dnsChallengesMu.Unlock()
 	return nil
 }
 
-func (m *Memory) GetDNSChallenge(cid string, domain string) (challenge string, ok bool) {
+func (m *Memory) GetDNSChallenges(cid string, label string) (challenges []string, ok bool) {
 	m.dnsChallengesMu.RLock()
-	challenge, ok = m.dnsChallenges[appendDomainToCID(cid, domain)]
+	for _, c := range m.dnsChallenges[appendLabelToCID(cid, label)] {
+		challenges = append(challenges, c.challenge)
+	}
 	m.dnsChallengesMu.RUnlock()
-	return
+	return challenges, len(challenges) > 0
 }
 
-func (m *Memory) RemoveDNSChallenge(cid string, domain string) error {
+func (m *Memory) RemoveDNSChallenge(cid string, label string, challenge string) error {
 	m.dnsChallengesMu.Lock()
-	key := appendDomainToCID(cid, domain)
-	if _, ok := m.dnsChallenges[key]; !ok {
-		m.dnsChallengesMu.Unlock()
-		return storage.ErrNotFound
+	key := appendLabelToCID(cid, label)
+	challenges := m.dnsChallenges[key]
+	for i, c := range challenges {
+		if c.challenge == challenge {
+			if len(challenges) == 1 {
+				delete(m.dnsChallenges, key)
+			} else {
+				m.dnsChallenges[key] = append(challenges[:i:i], challenges[i+1:]...)
+			}
+			m.dnsChallengesMu.Unlock()
+			return nil
+		}
 	}
-	delete(m.dnsChallenges, appendDomainToCID(cid, domain))
 	m.dnsChallengesMu.Unlock()
-	return nil
+	return storage.ErrNotFound
+}
+
+func (m *Memory) ExpireDNSChallenges(before time.Time) (expired int, err error) {
+	m.dnsChallengesMu.Lock()
+	for key, challenges := range m.dnsChallenges {
+		remaining := challenges[:0:0]
+		for _, c := range challenges {
+			if c.createdAt.Before(before) {
+				expired++
+				continue
+			}
+			remaining = append(remaining, c)
+		}
+		if len(remaining) == 0 {
+			delete(m.dnsChallenges, key)
+		} else {
+			m.dnsChallenges[key] = remaining
+		}
+	}
+	m.dnsChallengesMu.Unlock()
+	return
+}
+
+func (m *Memory) ListDNSChallenges(after storage.DNSChallenge, limit int) ([]storage.DNSChallenge, error) {
+	var challenges []storage.DNSChallenge
+	m.dnsChallengesMu.RLock()
+	for key, stored := range m.dnsChallenges {
+		label, cid := splitLabelFromCID(key)
+		for _, c := range stored {
+			challenge := storage.DNSChallenge{CID: cid, Label: label, Challenge: c.challenge, CreatedAt: c.createdAt}
+			if after.Less(challenge) {
+				challenges = append(challenges, challenge)
+			}
+		}
+	}
+	m.dnsChallengesMu.RUnlock()
+
+	sort.Slice(challenges, func(i, j int) bool {
+		return challenges[i].Less(challenges[j])
+	})
+	if limit > 0 && len(challenges) > limit {
+		challenges = challenges[:limit]
+	}
+	return challenges, nil
+}
+
+func appendLabelToCID(cid string, label string) string {
+	return utils.JoinStrings(label, ".", cid)
 }
 
-func appendDomainToCID(cid string, domain string) string {
-	return utils.JoinStrings(utils.NormalizeDomain(domain), ".", cid)
+func splitLabelFromCID(key string) (label string, cid string) {
+	label, cid, _ = strings.Cut(key, ".")
+	return
 }
@@ -19,42 +19,112 @@
 package acme
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/google/uuid"
+	"github.com/loopholelabs/certifier/pkg/keys"
 	"github.com/loopholelabs/certifier/pkg/options"
 	"github.com/loopholelabs/certifier/pkg/provider"
 	"github.com/loopholelabs/certifier/pkg/storage"
 	"github.com/loopholelabs/certifier/pkg/utils"
 	"github.com/loopholelabs/logging"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+const (
+	// RevokePageSize is the number of retired CIDs that are listed at a time when revoking the CIDs of an ID
+	RevokePageSize = 100
 )
 
 var (
 	// IDNotFoundError is returned when the given ID is not found in the storage
 	IDNotFoundError = errors.New("ID not found")
+
+	// NoDomainsError is returned when a certificate is requested without any domains
+	NoDomainsError = errors.New("no domains given")
+
+	// DomainNotAllowedError is returned when a certificate is requested for a domain that is not one of the allowed
+	// domains of the ID, and wraps the domain that was refused
+	DomainNotAllowedError = errors.New("domain not allowed")
+
+	// InvalidDelegationError is wrapped by the *DelegationError that is returned when the _acme-challenge
+	// CNAME record of a domain is missing or does not point at the CID of the ID
+	InvalidDelegationError = errors.New("invalid _acme-challenge delegation")
+
+	// InvalidDomainError is returned when a certificate is requested for a domain that is not a valid domain, or whose
+	// _acme-challenge record or CNAME target would be too long to be a valid domain, and wraps the reason it is invalid
+	InvalidDomainError = errors.New("invalid domain")
+
+	// InvalidDomainPatternError is returned when an allowed domain pattern contains a wildcard
+	// anywhere other than as its first label
+	InvalidDomainPatternError = errors.New("invalid domain pattern")
+
+	// CanceledError is returned when a certificate request is canceled before it completes, and wraps
+	// the cause of the cancellation (such as context.Canceled, context.DeadlineExceeded, or ShutdownError)
+	CanceledError = errors.New("certificate request canceled")
+
+	// NoRootError is returned when a delegation is requested or verified but no root domain was set using options.WithRoot
+	NoRootError = errors.New("no root domain set")
+
+	// ShutdownError is the cause of cancellation for certificate requests that are in progress when ACME is shut down
+	ShutdownError = errors.New("ACME shut down")
 )
 
 // ACME manages ACME DNS-01 Challenges
 type ACME struct {
 	// options contains the options used to configure this instance of ACME
 	options *options.Options
+
+	// root is the root domain of the dns.DNS instance that answers DNS-01 Challenges for this instance of ACME
+	root string
+
+	// ctx is canceled when this instance of ACME is shut down
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 }
 
-// New creates a new instance of ACME given a set of configuration
-// options
+// New creates a new instance of ACME given a set of configuration options
+//
+// The root domain of the dns.DNS instance that answers its DNS-01 Challenges must be set using options.WithRoot
+// to return or verify the _acme-challenge delegations of domains, otherwise NoRootError is returned for them,
+// and delegations are not checked before ordering certificates.
 func New(opts ...options.Option) *ACME {
-	return &ACME{
+	ctx, cancel := context.WithCancelCause(context.Background())
+	a := &ACME{
 		options: options.LoadOptions(opts...),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
+	if a.options.Root != "" {
+		a.root = dns.Fqdn(strings.ToLower(a.options.Root))
+	}
+	return a
+}
+
+// Shutdown cancels any certificate requests that are in progress, as well as any future ones
+func (a *ACME) Shutdown() {
+	a.logger().Infof("stopping ACME\n")
+	a.cancel(ShutdownError)
 }
 
 // RegisterCID registers a CID for a given ID and returns the generated CID
 func (a *ACME) RegisterCID(id string) (string, error) {
+	return a.RegisterCIDContext(context.Background(), id)
+}
+
+// RegisterCIDContext is the context-aware version of RegisterCID
+func (a *ACME) RegisterCIDContext(ctx context.Context, id string) (string, error) {
 	cid := uuid.New().String()
-	err := a.storage().SetCID(id, cid)
+	err := storage.SetCIDContext(ctx, a.storage(), id, cid)
 	if err != nil {
 		return "", err
 	}
@@ -62,26 +132,397 @@ func (a *ACME) RegisterCID(id string) (string, error) {
 	return cid, nil
 }
 
-// RenewDNS obtains an SSL Certificate using the DNS-01 Challenge for a given lego.Client and rsa.PrivateKey
-func (a *ACME) RenewDNS(id string, domain string, client *lego.Client, privateKey *rsa.PrivateKey) (*certificate.Resource, error) {
-	a.logger().Debugf("starting DNS certificate renewal for id '%s' and domain '%s'\n", id, domain)
-	cid, ok := a.storage().GetCID(id)
+// RotateCID replaces the CID registered for a given ID with a newly generated CID, and returns the new CID
+//
+// The old CID remains valid for the configured CIDGracePeriod, so that users
+// have time to point their _acme-challenge CNAME records at the new CID. If the new CID cannot be stored,
+// the old CID is restored for the ID.
+func (a *ACME) RotateCID(id string) (string, error) {
+	return a.RotateCIDContext(context.Background(), id)
+}
+
+// RotateCIDContext is the context-aware version of RotateCID
+func (a *ACME) RotateCIDContext(ctx context.Context, id string) (string, error) {
+	old, ok, err := storage.GetCIDContext(ctx, a.storage(), id)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", IDNotFoundError
+	}
+
+	// the old CID is retired before it is removed so that it never stops being valid
+	until := time.Now().Add(a.options.CIDGracePeriod)
+	err = storage.RetireCIDContext(ctx, a.storage(), old, id, until)
+	if err != nil {
+		return "", err
+	}
+
+	err = storage.RemoveCIDContext(ctx, a.storage(), id)
+	if err != nil {
+		return "", errors.Join(err, a.unretireCID(ctx, old))
+	}
+
+	cid := uuid.New().String()
+	err = storage.SetCIDContext(ctx, a.storage(), id, cid)
+	if err != nil {
+		// the old CID is restored so that the ID is never left without a CID
+		if restoreErr := storage.SetCIDContext(context.WithoutCancel(ctx), a.storage(), id, old); restoreErr != nil {
+			a.logger().Errorf("unable to restore CID '%s' for ID '%s' after failed rotation: %s\n", old, id, restoreErr)
+			return "", errors.Join(err, restoreErr)
+		}
+		return "", errors.Join(err, a.unretireCID(ctx, old))
+	}
+
+	a.logger().Infof("rotated CID for ID '%s' from '%s' to '%s', old CID valid until %s\n", id, old, cid, until)
+	return cid, nil
+}
+
+// unretireCID removes the retired CID that was recorded by a failed rotation
+func (a *ACME) unretireCID(ctx context.Context, cid string) error {
+	err := storage.RemoveRetiredCIDContext(context.WithoutCancel(ctx), a.storage(), cid)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		a.logger().Errorf("unable to remove retired CID '%s' after failed rotation: %s\n", cid, err)
+		return err
+	}
+	return nil
+}
+
+// RevokeCID immediately revokes the CID registered for a given ID, along with any of its
+// previous CIDs that are still within their grace period, so that dns.DNS stops answering for them
+//
+// A new CID can be registered for the ID afterwards using RegisterCID
+func (a *ACME) RevokeCID(id string) error {
+	return a.RevokeCIDContext(context.Background(), id)
+}
+
+// RevokeCIDContext is the context-aware version of RevokeCID
+func (a *ACME) RevokeCIDContext(ctx context.Context, id string) error {
+	found := false
+	err := storage.RemoveCIDContext(ctx, a.storage(), id)
+	switch {
+	case err == nil:
+		found = true
+	case !errors.Is(err, storage.ErrNotFound):
+		return err
+	}
+
+	after := ""
+	for {
+		retired, err := storage.ListRetiredCIDsContext(ctx, a.storage(), after, RevokePageSize)
+		if err != nil {
+			return err
+		}
+		if len(retired) == 0 {
+			break
+		}
+		for _, r := range retired {
+			if r.ID != id {
+				continue
+			}
+			err = storage.RemoveRetiredCIDContext(ctx, a.storage(), r.CID)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+			found = true
+		}
+		after = retired[len(retired)-1].CID
+	}
+
+	if !found {
+		return IDNotFoundError
+	}
+
+	a.logger().Infof("revoked CIDs for ID '%s'\n", id)
+	return nil
+}
+
+// SetAllowedDomains restricts the domains that certificates can be obtained for using the CIDs of a given ID
+// to the given domain patterns, replacing any patterns that were previously set
+//
+// A pattern is either a domain (example.com), which only allows that exact domain, or a wildcard domain
+// (*.example.com), which allows every subdomain of its base domain (including *.example.com itself)
+// but not the base domain. The DNS server also refuses to answer DNS-01 Challenges for domains outside
+// of these patterns.
+//
+// IDs without any allowed domains can obtain certificates for any domain, unless
+// RequireAllowedDomains is set, in which case they cannot obtain any certificates.
+func (a *ACME) SetAllowedDomains(id string, domains []string) error {
+	return a.SetAllowedDomainsContext(context.Background(), id, domains)
+}
+
+// SetAllowedDomainsContext is the context-aware version of SetAllowedDomains
+func (a *ACME) SetAllowedDomainsContext(ctx context.Context, id string, domains []string) error {
+	if len(domains) == 0 {
+		return NoDomainsError
+	}
+	for _, domain := range domains {
+		if domain == "" || strings.Contains(utils.TrimWildcard(domain), "*") {
+			return fmt.Errorf("%w: %q", InvalidDomainPatternError, domain)
+		}
+	}
+
+	err := storage.SetAllowedDomainsContext(ctx, a.storage(), id, domains)
+	if err != nil {
+		return err
+	}
+	a.logger().Infof("set allowed domains for ID '%s' to %q\n", id, domains)
+	return nil
+}
+
+// RemoveAllowedDomains removes the allowed domains of a given ID
+func (a *ACME) RemoveAllowedDomains(id string) error {
+	return a.RemoveAllowedDomainsContext(context.Background(), id)
+}
+
+// RemoveAllowedDomainsContext is the context-aware version of RemoveAllowedDomains
+func (a *ACME) RemoveAllowedDomainsContext(ctx context.Context, id string) error {
+	return storage.RemoveAllowedDomainsContext(ctx, a.storage(), id)
+}
+
+// RenewDNS obtains an SSL Certificate using the DNS-01 Challenge for a given lego.Client and crypto.Signer
+//
+// If privateKey is nil, a new private key of the configured KeyType is generated for the certificate
+func (a *ACME) RenewDNS(id string, domain string, client *lego.Client, privateKey crypto.Signer) (*certificate.Resource, error) {
+	return a.RenewDNSContext(context.Background(), id, domain, client, privateKey)
+}
+
+// RenewDNSContext is the context-aware version of RenewDNS
+func (a *ACME) RenewDNSContext(ctx context.Context, id string, domain string, client *lego.Client, privateKey crypto.Signer) (*certificate.Resource, error) {
+	return a.RenewDNSDomainsContext(ctx, id, []string{domain}, client, privateKey)
+}
+
+// RenewDNSDomains obtains a single SSL Certificate covering all the given domains using the DNS-01 Challenge
+// for a given lego.Client and crypto.Signer
+//
+// The obtained certificate is stored in the configured storage.CertificateStorage, and if it could not
+// be stored both the certificate and the error are returned, so that the certificate is not lost
+//
+// Domains may include wildcard domains (*.example.com), in which case the challenge is performed against the
+// base domain (example.com). The first domain is used as the Common Name of the certificate.
+//
+// Before the certificate is ordered, the _acme-challenge CNAME record of every domain is resolved using the
+// trusted nameservers, and a *DelegationError is returned if any of them is missing or points at the wrong target
+// (unless SkipDelegationCheck is set).
+//
+// Any RSA, ECDSA, or Ed25519 private key can be used, and if privateKey is nil, a new
+// private key of the configured KeyType is generated for the certificate. Since the private key is stored
+// alongside the certificate, other crypto.Signer implementations (such as keys held in a KMS or an HSM) cannot
+// be exported and are rejected with keys.ErrUnsupportedKey before the certificate is ordered.
+func (a *ACME) RenewDNSDomains(id string, domains []string, client *lego.Client, privateKey crypto.Signer) (*certificate.Resource, error) {
+	return a.RenewDNSDomainsContext(context.Background(), id, domains, client, privateKey)
+}
+
+// RenewDNSDomainsContext is the context-aware version of RenewDNSDomains
+//
+// If the context is done (or ACME is shut down) before the certificate is obtained, any challenges that
+// were presented are cleaned up and an error wrapping CanceledError is returned. Since lego is unable to
+// abort an order that is in progress, the given lego.Client must not be reused until the order has failed.
+func (a *ACME) RenewDNSDomainsContext(ctx context.Context, id string, domains []string, client *lego.Client, privateKey crypto.Signer) (*certificate.Resource, error) {
+	if len(domains) == 0 {
+		return nil, NoDomainsError
+	}
+
+	ctx, cancel := a.withShutdown(ctx)
+	defer cancel(nil)
+
+	a.logger().Debugf("starting DNS certificate renewal for id '%s' and domains %q\n", id, domains)
+	cid, ok, err := storage.GetCIDContext(ctx, a.storage(), id)
+	if err != nil {
+		return nil, canceled(ctx, err)
+	}
 	if !ok {
 		return nil, IDNotFoundError
 	}
 
-	err := client.Challenge.SetDNS01Provider(provider.New(cid, utils.NormalizeDomain(domain), a.options), dns01.AddRecursiveNameservers(a.trustedNameServers()))
+	for _, domain := range domains {
+		err = a.checkDomain(cid, domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = a.checkAllowedDomains(ctx, id, domains)
+	if err != nil {
+		return nil, canceled(ctx, err)
+	}
+
+	// the delegation is checked before ordering the certificate so that a missing or incorrect CNAME
+	// record does not use up an authorization, unless the CNAME targets are unknown since no root domain was set
+	switch {
+	case a.options.SkipDelegationCheck:
+	case a.root == "":
+		a.logger().Warnf("skipping delegation check for id '%s' and domains %q since no root domain was set\n", id, domains)
+	default:
+		err = a.checkDelegation(ctx, id, cid, domains)
+		if err != nil {
+			return nil, canceled(ctx, err)
+		}
+	}
+
+	if privateKey == nil {
+		privateKey, err = keys.Generate(a.keyType())
+		if err != nil {
+			return nil, err
+		}
+		a.logger().Debugf("generated new %s private key for id '%s' and domains %q\n", a.keyType(), id, domains)
+	}
+
+	privateKeyPEM, err := keys.PEMEncode(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	certRequest := certificate.ObtainRequest{
-		Domains:    []string{domain},
-		Bundle:     false,
-		PrivateKey: privateKey,
+	csr, err := certcrypto.GenerateCSR(privateKey, commonName(domains), domains, false)
+	if err != nil {
+		return nil, err
 	}
 
-	return client.Certificate.Obtain(certRequest)
+	parsedCSR, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := provider.NewWithContext(ctx, cid, a.options)
+	err = client.Challenge.SetDNS01Provider(p, dns01.AddRecursiveNameservers(a.trustedNameServers()), dns01.WrapPreCheck(p.PreCheck))
+	if err != nil {
+		return nil, err
+	}
+
+	// the certificate is requested using a CSR (rather than certificate.ObtainRequest) because
+	// lego is unable to encode private keys that are not RSA or ECDSA keys
+	certRequest := certificate.ObtainForCSRRequest{
+		CSR:    parsedCSR,
+		Bundle: false,
+	}
+
+	type result struct {
+		resource *certificate.Resource
+		err      error
+	}
+	obtained := make(chan result, 1)
+	go func() {
+		resource, err := client.Certificate.ObtainForCSR(certRequest)
+		obtained <- result{resource: resource, err: err}
+	}()
+
+	var resource *certificate.Resource
+	select {
+	case r := <-obtained:
+		if r.err != nil {
+			return nil, canceled(ctx, r.err)
+		}
+		resource = r.resource
+	case <-ctx.Done():
+		a.logger().Warnf("certificate renewal for id '%s' and domains %q canceled: %s\n", id, domains, context.Cause(ctx))
+		if err = p.CleanUpAll(); err != nil {
+			a.logger().Errorf("unable to clean up challenges for id '%s' and domains %q: %s\n", id, domains, err)
+		}
+		return nil, canceled(ctx, ctx.Err())
+	}
+	resource.PrivateKey = privateKeyPEM
+
+	err = a.storeCertificate(id, domains, resource)
+	if err != nil {
+		a.logger().Errorf("unable to store certificate for id '%s' and domains %q: %s\n", id, domains, err)
+		return resource, err
+	}
+
+	return resource, nil
+}
+
+// checkDomain returns an error wrapping InvalidDomainError if the given domain is not a valid domain, or if its
+// _acme-challenge record or its CNAME target for the given CID would be longer than utils.MaxDomainLength
+func (a *ACME) checkDomain(cid string, domain string) error {
+	base := strings.TrimSuffix(utils.TrimWildcard(domain), ".")
+	if len(base) > utils.MaxDomainLength {
+		return fmt.Errorf("%w: %s is longer than %d characters", InvalidDomainError, domain, utils.MaxDomainLength)
+	}
+	for _, label := range strings.Split(base, ".") {
+		if !validLabel(label) {
+			return fmt.Errorf("%w: %s must be made up of labels between 1 and %d letters, digits, and hyphens long that do not start or end with a hyphen, with an optional leading wildcard", InvalidDomainError, domain, utils.MaxLabelLength)
+		}
+	}
+	if name := challengeName(domain); len(name)-1 > utils.MaxDomainLength {
+		return fmt.Errorf("%w: the challenge record %s of %s is longer than %d characters", InvalidDomainError, name, domain, utils.MaxDomainLength)
+	}
+	if target := a.challengeTarget(cid, domain); len(target)-1 > utils.MaxDomainLength {
+		return fmt.Errorf("%w: the CNAME target %s of %s is longer than %d characters", InvalidDomainError, target, domain, utils.MaxDomainLength)
+	}
+	return nil
+}
+
+// validLabel checks whether a label of a domain is between 1 and MaxLabelLength letters, digits, and hyphens long,
+// and does not start or end with a hyphen, which is required for EncodeDomain to encode the domain unambiguously
+func validLabel(label string) bool {
+	if label == "" || len(label) > utils.MaxLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAllowedDomains returns an error wrapping DomainNotAllowedError if any of the
+// given domains is not one of the allowed domains of the given ID
+func (a *ACME) checkAllowedDomains(ctx context.Context, id string, domains []string) error {
+	allowed, ok, err := storage.GetAllowedDomainsContext(ctx, a.storage(), id)
+	if err != nil {
+		return err
+	}
+	if !ok && !a.options.RequireAllowedDomains {
+		return nil
+	}
+	for _, domain := range domains {
+		if !utils.DomainAllowed(allowed, domain) {
+			a.logger().Warnf("refusing certificate request for id '%s' and domain '%s' which is not allowed\n", id, domain)
+			return fmt.Errorf("%w: %s", DomainNotAllowedError, domain)
+		}
+	}
+	return nil
+}
+
+// withShutdown returns a context that is canceled when either the given context
+// is done or this instance of ACME is shut down
+func (a *ACME) withShutdown(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if a.ctx.Err() != nil {
+		// context.AfterFunc runs asynchronously, so requests made after
+		// shutting down must be canceled before they start
+		cancel(context.Cause(a.ctx))
+	}
+	stop := context.AfterFunc(a.ctx, func() {
+		cancel(context.Cause(a.ctx))
+	})
+	return ctx, func(cause error) {
+		stop()
+		cancel(cause)
+	}
+}
+
+// storeCertificate stores an obtained certificate in the configured storage.CertificateStorage
+func (a *ACME) storeCertificate(id string, domains []string, resource *certificate.Resource) error {
+	cert, err := certcrypto.ParsePEMCertificate(resource.Certificate)
+	if err != nil {
+		return err
+	}
+
+	return a.certificateStorage().SetCertificate(&storage.Certificate{
+		ID:                id,
+		Domain:            domains[0],
+		Domains:           domains,
+		Certificate:       resource.Certificate,
+		IssuerCertificate: resource.IssuerCertificate,
+		PrivateKey:        resource.PrivateKey,
+		CertURL:           resource.CertURL,
+		Issuer:            cert.Issuer.CommonName,
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+	})
 }
 
 // logger returns the logging interface for this instance of ACME
@@ -94,7 +535,35 @@ func (a *ACME) storage() storage.Storage {
 	return a.options.Storage
 }
 
+// certificateStorage returns the certificate storage interface for this instance of ACME
+func (a *ACME) certificateStorage() storage.CertificateStorage {
+	return a.options.CertificateStorage
+}
+
+// keyType returns the key type used to generate certificate private keys for this instance of ACME
+func (a *ACME) keyType() keys.Type {
+	return a.options.KeyType
+}
+
 // trustedNameServers returns the trusted nameservers for this instance of ACME
 func (a *ACME) trustedNameServers() []string {
 	return a.options.TrustedNameServers
 }
+
+// commonName returns the Common Name for a certificate covering the given domains,
+// which is the first domain unless it is too long to be used as a Common Name
+func commonName(domains []string) string {
+	if len(domains[0]) > 64 {
+		return ""
+	}
+	return domains[0]
+}
+
+// canceled returns an error wrapping both CanceledError and the cause of the cancellation if
+// the given context is done, and otherwise returns the given error unchanged
+func canceled(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", CanceledError, context.Cause(ctx))
+}
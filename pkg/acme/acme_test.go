@@ -0,0 +1,321 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	rootDomain = "acme.example.com"
+)
+
+// user is a registration.User with an existing account
+type user struct {
+	registration *registration.Resource
+	privateKey   crypto.PrivateKey
+}
+
+func (u *user) GetEmail() string                        { return "" }
+func (u *user) GetRegistration() *registration.Resource { return u.registration }
+func (u *user) GetPrivateKey() crypto.PrivateKey        { return u.privateKey }
+
+// testClient returns a lego.Client for an ACME server that creates a pending order with a DNS-01
+// challenge for every order, and never validates the challenges
+func testClient(t *testing.T, domain string) *lego.Client {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Content-Type", "application/json")
+		var body any
+		switch r.URL.Path {
+		case "/directory":
+			body = map[string]string{
+				"newNonce":   server.URL + "/nonce",
+				"newAccount": server.URL + "/account",
+				"newOrder":   server.URL + "/order",
+				"revokeCert": server.URL + "/revoke",
+				"keyChange":  server.URL + "/key-change",
+			}
+		case "/nonce":
+			return
+		case "/order":
+			w.Header().Set("Location", server.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			body = map[string]any{
+				"status":         "pending",
+				"identifiers":    []map[string]string{{"type": "dns", "value": domain}},
+				"authorizations": []string{server.URL + "/authorization"},
+				"finalize":       server.URL + "/finalize",
+			}
+		case "/authorization":
+			body = map[string]any{
+				"status":     "pending",
+				"identifier": map[string]string{"type": "dns", "value": domain},
+				"challenges": []map[string]string{{"type": "dns-01", "url": server.URL + "/challenge", "token": "token", "status": "pending"}},
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(server.Close)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	config := lego.NewConfig(&user{registration: &registration.Resource{URI: server.URL + "/account/1"}, privateKey: privateKey})
+	config.CADirURL = server.URL + "/directory"
+	client, err := lego.NewClient(config)
+	require.NoError(t, err)
+	return client
+}
+
+// cancelOnPresent returns a context that is canceled once a challenge for the given domain has been presented for the given CID
+func cancelOnPresent(t *testing.T, s storage.Storage, cid string, domain string) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		for ctx.Err() == nil {
+			if _, ok := s.GetDNSChallenges(cid, utils.EncodeDomain(domain)); ok {
+				cancel()
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+	return ctx
+}
+
+func TestRenewDNSDomainsContext(t *testing.T) {
+	t.Parallel()
+
+	a := New(options.WithRoot(rootDomain), options.WithStorage(memory.New()))
+
+	_, err := a.RenewDNSDomains("id", nil, nil, nil)
+	assert.ErrorIs(t, err, NoDomainsError)
+
+	_, err = a.RenewDNS("id", "example.com", nil, nil)
+	assert.ErrorIs(t, err, IDNotFoundError)
+
+	_, err = a.RegisterCID("id")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = a.RenewDNSContext(ctx, "id", "example.com", nil, nil)
+	assert.ErrorIs(t, err, CanceledError)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	a.Shutdown()
+	_, err = a.RenewDNS("id", "example.com", nil, nil)
+	assert.ErrorIs(t, err, CanceledError)
+	assert.ErrorIs(t, err, ShutdownError)
+}
+
+func TestRenewDNSDomainsContextCanceled(t *testing.T) {
+	t.Parallel()
+
+	s := memory.New()
+	a := New(options.WithRoot(rootDomain), options.WithStorage(s), options.WithSkipDelegationCheck(true))
+	cid, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	// the order is canceled once the challenge has been presented, while lego is waiting for it to propagate
+	ctx := cancelOnPresent(t, s, cid, "example.com")
+	_, err = a.RenewDNSContext(ctx, "id", "example.com", testClient(t, "example.com"), nil)
+	assert.ErrorIs(t, err, CanceledError)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	challenges, err := s.ListDNSChallenges(storage.DNSChallenge{}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, challenges)
+}
+
+func TestRotateRevokeCID(t *testing.T) {
+	t.Parallel()
+
+	s := memory.New()
+	a := New(options.WithRoot(rootDomain), options.WithStorage(s), options.WithCIDGracePeriod(time.Hour))
+
+	_, err := a.RotateCID("id")
+	assert.ErrorIs(t, err, IDNotFoundError)
+	assert.ErrorIs(t, a.RevokeCID("id"), IDNotFoundError)
+
+	first, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	second, err := a.RotateCID("id")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	cid, ok := s.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, second, cid)
+
+	retired, ok := s.GetRetiredCID(first)
+	require.True(t, ok)
+	assert.Equal(t, "id", retired.ID)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), retired.Until, time.Minute)
+
+	third, err := a.RotateCID("id")
+	require.NoError(t, err)
+
+	require.NoError(t, a.RevokeCID("id"))
+	for _, cid := range []string{first, second, third} {
+		_, ok = s.GetID(cid)
+		assert.False(t, ok)
+		_, ok = s.GetRetiredCID(cid)
+		assert.False(t, ok)
+	}
+	assert.ErrorIs(t, a.RevokeCID("id"), IDNotFoundError)
+}
+
+// failingStorage is a storage.Storage that fails the next failures calls to SetCID
+type failingStorage struct {
+	*memory.Memory
+	failures int
+}
+
+func (s *failingStorage) SetCID(id string, cid string) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("set cid failed")
+	}
+	return s.Memory.SetCID(id, cid)
+}
+
+func TestRotateCIDFailure(t *testing.T) {
+	t.Parallel()
+
+	s := &failingStorage{Memory: memory.New()}
+	a := New(options.WithRoot(rootDomain), options.WithStorage(s))
+
+	cid, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	// the old CID is restored when the new CID cannot be set
+	s.failures = 1
+	_, err = a.RotateCID("id")
+	assert.EqualError(t, err, "set cid failed")
+
+	restored, ok := s.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, cid, restored)
+	_, ok = s.GetRetiredCID(cid)
+	assert.False(t, ok)
+
+	// the old CID remains retired when it cannot be restored either
+	s.failures = 2
+	_, err = a.RotateCID("id")
+	assert.ErrorContains(t, err, "set cid failed")
+
+	_, ok = s.GetCID("id")
+	assert.False(t, ok)
+	retired, ok := s.GetRetiredCID(cid)
+	require.True(t, ok)
+	assert.Equal(t, "id", retired.ID)
+}
+
+func TestAllowedDomains(t *testing.T) {
+	t.Parallel()
+
+	a := New(options.WithRoot(rootDomain), options.WithStorage(memory.New()))
+	_, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, a.SetAllowedDomains("id", nil), NoDomainsError)
+	assert.ErrorIs(t, a.SetAllowedDomains("id", []string{"a.*.example.com"}), InvalidDomainPatternError)
+	require.NoError(t, a.SetAllowedDomains("id", []string{"example.com", "*.example.org"}))
+
+	for _, domains := range [][]string{{"other.com"}, {"a.example.com"}, {"example.org"}, {"example.com", "other.com"}} {
+		_, err = a.RenewDNSDomains("id", domains, nil, nil)
+		assert.ErrorIs(t, err, DomainNotAllowedError, "domains %q", domains)
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, a.checkAllowedDomains(ctx, "id", []string{"EXAMPLE.com", "*.example.org", "a.b.example.org"}))
+	assert.ErrorIs(t, a.checkAllowedDomains(ctx, "id", []string{"other.com"}), DomainNotAllowedError)
+
+	require.NoError(t, a.RemoveAllowedDomains("id"))
+	assert.NoError(t, a.checkAllowedDomains(ctx, "id", []string{"other.com"}))
+
+	required := New(options.WithRoot(rootDomain), options.WithStorage(memory.New()), options.WithRequireAllowedDomains(true))
+	_, err = required.RegisterCID("id")
+	require.NoError(t, err)
+	_, err = required.RenewDNS("id", "example.com", nil, nil)
+	assert.ErrorIs(t, err, DomainNotAllowedError)
+	assert.ErrorIs(t, required.checkAllowedDomains(ctx, "id", []string{"example.com"}), DomainNotAllowedError)
+}
+
+func TestInvalidDomains(t *testing.T) {
+	t.Parallel()
+
+	a := New(options.WithRoot(rootDomain), options.WithStorage(memory.New()))
+	cid, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	label := strings.Repeat("a", 63)
+	for _, domain := range []string{
+		strings.Repeat("a", 64) + ".com",
+		"a..example.com",
+		"a.*.example.com",
+		strings.Repeat(label+".", 3) + strings.Repeat("b", 50) + ".com",
+		strings.Repeat(label+".", 4) + "com",
+		"a_b.com",
+		"a b.com",
+		"a-.b.com",
+		"a.-b.com",
+		"*.-a.com",
+		"a.b.com-",
+	} {
+		_, err = a.RenewDNS("id", domain, nil, nil)
+		assert.ErrorIs(t, err, InvalidDomainError, domain)
+		_, err = a.DelegationInstructions("id", domain)
+		assert.ErrorIs(t, err, InvalidDomainError, domain)
+	}
+
+	// long domains are encoded to a hashed label, which keeps their CNAME target valid
+	domain := strings.Repeat(label+".", 2) + "example.com"
+	d, err := a.DelegationInstructions("id", "*."+domain)
+	require.NoError(t, err)
+	assert.Equal(t, utils.HashedLabel(domain)+"."+cid+"."+rootDomain+".", d.Target)
+
+	assert.NoError(t, a.checkDomain(cid, domain))
+	assert.NoError(t, a.checkDomain(cid, "*."+domain))
+	assert.NoError(t, a.checkDomain(cid, "A-1.example.com."))
+}
@@ -0,0 +1,288 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package acme
+
+import (
+	"context"
+	"fmt"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+const (
+	// ChallengeLabel is the label that is prepended to a domain to get the name of its DNS-01 Challenge record
+	ChallengeLabel = "_acme-challenge."
+)
+
+// DelegationStatus is the live verification status of the _acme-challenge CNAME record of a domain
+type DelegationStatus string
+
+const (
+	// DelegationVerified means the CNAME record points at the current CID of the ID
+	DelegationVerified DelegationStatus = "verified"
+
+	// DelegationRotated means the CNAME record points at a rotated CID of the ID that is still within its
+	// grace period, so certificates can still be obtained but the record must be updated before the grace period ends
+	DelegationRotated DelegationStatus = "rotated"
+
+	// DelegationMissing means there is no CNAME record
+	DelegationMissing DelegationStatus = "missing"
+
+	// DelegationMismatch means the CNAME record points at the wrong target
+	DelegationMismatch DelegationStatus = "mismatch"
+)
+
+// Delegation describes the _acme-challenge CNAME record that must be created for a domain so that
+// certificates can be obtained for it, along with the live status of that record once it has been verified
+type Delegation struct {
+	// Domain is the domain that certificates will be obtained for
+	Domain string
+
+	// Name is the name of the CNAME record that must be created (_acme-challenge.<domain>)
+	Name string
+
+	// Target is the target that the CNAME record must point at (<encoded domain>.<cid>.<root>)
+	Target string
+
+	// Found is the target that the CNAME record currently points at, and is empty if there is no
+	// CNAME record or if the record has not been verified
+	Found string
+
+	// Status is the live verification status of the CNAME record, and is empty if it has not been verified
+	Status DelegationStatus
+}
+
+// Valid reports whether certificates can currently be obtained using the delegation
+func (d *Delegation) Valid() bool {
+	return d.Status == DelegationVerified || d.Status == DelegationRotated
+}
+
+// DelegationInstructions returns the _acme-challenge CNAME record that must be created
+// so that certificates can be obtained for the given domain using the CID of the given ID
+//
+// Wildcard domains (*.example.com) use the record of their base domain (example.com), and an
+// error wrapping InvalidDomainError is returned if the record cannot be represented
+func (a *ACME) DelegationInstructions(id string, domain string) (*Delegation, error) {
+	return a.DelegationInstructionsContext(context.Background(), id, domain)
+}
+
+// DelegationInstructionsContext is the context-aware version of DelegationInstructions
+func (a *ACME) DelegationInstructionsContext(ctx context.Context, id string, domain string) (*Delegation, error) {
+	if a.root == "" {
+		return nil, NoRootError
+	}
+	cid, ok, err := storage.GetCIDContext(ctx, a.storage(), id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, IDNotFoundError
+	}
+	if err = a.checkDomain(cid, domain); err != nil {
+		return nil, err
+	}
+	return a.delegation(cid, domain), nil
+}
+
+// VerifyDelegation returns the _acme-challenge CNAME record that must be created for the given domain (as
+// DelegationInstructions does), along with its live status as resolved using the trusted nameservers
+func (a *ACME) VerifyDelegation(id string, domain string) (*Delegation, error) {
+	return a.VerifyDelegationContext(context.Background(), id, domain)
+}
+
+// VerifyDelegationContext is the context-aware version of VerifyDelegation
+func (a *ACME) VerifyDelegationContext(ctx context.Context, id string, domain string) (*Delegation, error) {
+	cid, ok, err := storage.GetCIDContext(ctx, a.storage(), id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, IDNotFoundError
+	}
+	if err = a.checkDomain(cid, domain); err != nil {
+		return nil, err
+	}
+	return a.verifyDelegation(ctx, id, cid, domain)
+}
+
+// delegation returns the _acme-challenge CNAME record that must be created for the given CID and domain
+func (a *ACME) delegation(cid string, domain string) *Delegation {
+	return &Delegation{
+		Domain: domain,
+		Name:   challengeName(domain),
+		Target: a.challengeTarget(cid, domain),
+	}
+}
+
+// verifyDelegation resolves the _acme-challenge CNAME record of the given
+// domain and checks it against the given CID and ID
+func (a *ACME) verifyDelegation(ctx context.Context, id string, cid string, domain string) (*Delegation, error) {
+	if a.root == "" {
+		return nil, NoRootError
+	}
+	d := a.delegation(cid, domain)
+	found, err := a.lookupCNAME(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Found = found
+	target, ok := a.targetCID(domain, found)
+	switch {
+	case found == "":
+		d.Status = DelegationMissing
+	case found == d.Target || (ok && target == cid):
+		d.Status = DelegationVerified
+	case ok && a.retiredCID(ctx, id, target):
+		d.Status = DelegationRotated
+	default:
+		d.Status = DelegationMismatch
+	}
+	return d, nil
+}
+
+// DelegationError is returned when the _acme-challenge CNAME record of a domain is missing or does
+// not point at the CID of the ID that a certificate is being requested for, and wraps InvalidDelegationError
+type DelegationError struct {
+	// Domain is the domain the certificate was requested for
+	Domain string
+
+	// Name is the name of the CNAME record (_acme-challenge.<domain>)
+	Name string
+
+	// Expected is the target that the CNAME record must point at
+	Expected string
+
+	// Found is the target that the CNAME record points at, and is empty if there is no CNAME record
+	Found string
+}
+
+func (e *DelegationError) Error() string {
+	found := "no CNAME record"
+	if e.Found != "" {
+		found = fmt.Sprintf("a CNAME record pointing at %s", e.Found)
+	}
+	return fmt.Sprintf("%s: expected %s to be a CNAME record pointing at %s, but found %s", InvalidDelegationError, e.Name, e.Expected, found)
+}
+
+func (e *DelegationError) Unwrap() error {
+	return InvalidDelegationError
+}
+
+// checkDelegation resolves the _acme-challenge CNAME record of every given domain and returns a
+// *DelegationError if any of them does not point at the given CID (or at a rotated CID of the same
+// ID that is still within its grace period)
+func (a *ACME) checkDelegation(ctx context.Context, id string, cid string, domains []string) error {
+	checked := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		// wildcard domains share the challenge record of their base domain
+		name := challengeName(domain)
+		if _, ok := checked[name]; ok {
+			continue
+		}
+		checked[name] = struct{}{}
+
+		d, err := a.verifyDelegation(ctx, id, cid, domain)
+		if err != nil {
+			return err
+		}
+		if d.Valid() {
+			continue
+		}
+
+		a.logger().Warnf("invalid delegation for id '%s' and domain '%s': expected %s to point at %s, found '%s'\n", id, domain, d.Name, d.Target, d.Found)
+		return &DelegationError{
+			Domain:   domain,
+			Name:     d.Name,
+			Expected: d.Target,
+			Found:    d.Found,
+		}
+	}
+	return nil
+}
+
+// targetCID returns the CID that the given CNAME target points at, as long as the target is
+// the challenge target of the given domain for some CID, using any of the labels of the domain
+func (a *ACME) targetCID(domain string, target string) (string, bool) {
+	label, rest, ok := strings.Cut(target, ".")
+	if !ok {
+		return "", false
+	}
+	cid, ok := strings.CutSuffix(rest, utils.JoinStrings(".", a.root))
+	if !ok {
+		return "", false
+	}
+	for _, l := range utils.ChallengeLabels(domain, a.options.LegacyLabels) {
+		if l == label {
+			return cid, true
+		}
+	}
+	return "", false
+}
+
+// retiredCID checks whether the given CID is a rotated CID of the given ID that is still within its grace period
+func (a *ACME) retiredCID(ctx context.Context, id string, cid string) bool {
+	retired, ok, err := storage.GetRetiredCIDContext(ctx, a.storage(), cid)
+	return err == nil && ok && retired.ID == id && time.Now().Before(retired.Until)
+}
+
+// lookupCNAME resolves the target of the CNAME record with the given name using the trusted nameservers,
+// returning an empty target if there is no CNAME record
+//
+// Each trusted nameserver is tried in turn until one of them answers
+func (a *ACME) lookupCNAME(ctx context.Context, name string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeCNAME)
+	m.RecursionDesired = true
+
+	client := new(dns.Client)
+	var err error
+	for _, nameserver := range a.trustedNameServers() {
+		var in *dns.Msg
+		in, _, err = client.ExchangeContext(ctx, m, nameserver)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("nameserver %s returned %s", nameserver, dns.RcodeToString[in.Rcode])
+			continue
+		}
+		for _, rr := range in.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				return strings.ToLower(dns.Fqdn(cname.Target)), nil
+			}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unable to resolve %s: %w", name, err)
+}
+
+// challengeTarget returns the name that the _acme-challenge CNAME record of the given domain must point at for the given CID
+func (a *ACME) challengeTarget(cid string, domain string) string {
+	return utils.JoinStrings(utils.EncodeDomain(utils.TrimWildcard(domain)), ".", cid, ".", a.root)
+}
+
+// challengeName returns the name of the _acme-challenge CNAME record of the given domain
+func challengeName(domain string) string {
+	return dns.Fqdn(utils.JoinStrings(ChallengeLabel, strings.ToLower(utils.TrimWildcard(domain))))
+}
@@ -0,0 +1,194 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package acme
+
+import (
+	"context"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// startResolver starts a DNS server that answers CNAME queries using the given records, and returns its address
+func startResolver(t *testing.T, records map[string]string) string {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{
+		PacketConn: packetConn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if target, ok := records[r.Question[0].Name]; ok {
+				m.Answer = append(m.Answer, &dns.CNAME{
+					Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+					Target: target,
+				})
+			} else {
+				m.Rcode = dns.RcodeNameError
+			}
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return packetConn.LocalAddr().String()
+}
+
+func TestCheckDelegation(t *testing.T) {
+	t.Parallel()
+
+	resolver := startResolver(t, map[string]string{
+		"_acme-challenge.example.com.": "example-com.cid." + rootDomain + ".",
+		"_acme-challenge.example.org.": "example-org.other." + rootDomain + ".",
+		"_acme-challenge.example.net.": "example-net.retired." + rootDomain + ".",
+		"_acme-challenge.example.io.":  "example-io.expired." + rootDomain + ".",
+	})
+
+	s := memory.New()
+	require.NoError(t, s.SetCID("id", "cid"))
+	require.NoError(t, s.RetireCID("retired", "id", time.Now().Add(time.Hour)))
+	require.NoError(t, s.RetireCID("expired", "id", time.Now().Add(-time.Hour)))
+	a := New(options.WithRoot(rootDomain), options.WithStorage(s), options.WithTrustedNameservers([]string{resolver}))
+	ctx := context.Background()
+
+	require.NoError(t, a.checkDelegation(ctx, "id", "cid", []string{"example.com", "*.example.com", "EXAMPLE.com"}))
+
+	// rotated CIDs are accepted while they are within their grace period
+	require.NoError(t, a.checkDelegation(ctx, "id", "cid", []string{"example.net"}))
+
+	var delegationErr *DelegationError
+	err := a.checkDelegation(ctx, "id", "cid", []string{"example.com", "example.org"})
+	require.ErrorAs(t, err, &delegationErr)
+	assert.ErrorIs(t, err, InvalidDelegationError)
+	assert.Equal(t, "example.org", delegationErr.Domain)
+	assert.Equal(t, "_acme-challenge.example.org.", delegationErr.Name)
+	assert.Equal(t, "example-org.cid."+rootDomain+".", delegationErr.Expected)
+	assert.Equal(t, "example-org.other."+rootDomain+".", delegationErr.Found)
+
+	err = a.checkDelegation(ctx, "id", "cid", []string{"*.missing.com"})
+	require.ErrorAs(t, err, &delegationErr)
+	assert.Equal(t, "_acme-challenge.missing.com.", delegationErr.Name)
+	assert.Empty(t, delegationErr.Found)
+	assert.Contains(t, err.Error(), "no CNAME record")
+
+	err = a.checkDelegation(ctx, "id", "cid", []string{"example.io"})
+	assert.ErrorIs(t, err, InvalidDelegationError)
+
+	// the delegation is checked before the certificate is ordered, so a nil client is never used
+	_, err = a.RenewDNS("id", "example.org", nil, nil)
+	assert.ErrorIs(t, err, InvalidDelegationError)
+}
+
+func TestVerifyDelegation(t *testing.T) {
+	t.Parallel()
+
+	resolver := startResolver(t, map[string]string{
+		"_acme-challenge.example.com.": "example-com.cid." + rootDomain + ".",
+		"_acme-challenge.example.org.": "example-org.other." + rootDomain + ".",
+		"_acme-challenge.example.net.": "example-net.retired." + rootDomain + ".",
+		"_acme-challenge.my-site.com.": "my-site-com.cid." + rootDomain + ".",
+	})
+
+	s := memory.New()
+	a := New(options.WithRoot(rootDomain), options.WithStorage(s), options.WithTrustedNameservers([]string{resolver}))
+
+	_, err := a.DelegationInstructions("id", "example.com")
+	assert.ErrorIs(t, err, IDNotFoundError)
+	_, err = a.VerifyDelegation("id", "example.com")
+	assert.ErrorIs(t, err, IDNotFoundError)
+
+	require.NoError(t, s.SetCID("id", "cid"))
+	require.NoError(t, s.RetireCID("retired", "id", time.Now().Add(time.Hour)))
+
+	d, err := a.DelegationInstructions("id", "*.Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &Delegation{
+		Domain: "*.Example.com",
+		Name:   "_acme-challenge.example.com.",
+		Target: "example-com.cid." + rootDomain + ".",
+	}, d)
+
+	for domain, status := range map[string]DelegationStatus{
+		"example.com": DelegationVerified,
+		"example.net": DelegationRotated,
+		"example.org": DelegationMismatch,
+		"example.io":  DelegationMissing,
+	} {
+		d, err = a.VerifyDelegation("id", domain)
+		require.NoError(t, err)
+		assert.Equal(t, status, d.Status, domain)
+		assert.Equal(t, status == DelegationVerified || status == DelegationRotated, d.Valid(), domain)
+		if status == DelegationMissing {
+			assert.Empty(t, d.Found)
+		} else {
+			assert.NotEmpty(t, d.Found)
+		}
+	}
+
+	d, err = a.DelegationInstructions("id", "my-site.com")
+	require.NoError(t, err)
+	assert.Equal(t, "my--site-com.cid."+rootDomain+".", d.Target)
+
+	// CNAME records that use the legacy label of a domain are only accepted once legacy labels are enabled
+	d, err = a.VerifyDelegation("id", "my-site.com")
+	require.NoError(t, err)
+	assert.Equal(t, DelegationMismatch, d.Status)
+
+	legacy := New(options.WithRoot(rootDomain), options.WithStorage(s), options.WithTrustedNameservers([]string{resolver}), options.WithLegacyLabels(true))
+	d, err = legacy.VerifyDelegation("id", "my-site.com")
+	require.NoError(t, err)
+	assert.Equal(t, DelegationVerified, d.Status)
+}
+
+func TestNoRoot(t *testing.T) {
+	t.Parallel()
+
+	a := New(options.WithStorage(memory.New()))
+	_, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	_, err = a.DelegationInstructions("id", "example.com")
+	assert.ErrorIs(t, err, NoRootError)
+	_, err = a.VerifyDelegation("id", "example.com")
+	assert.ErrorIs(t, err, NoRootError)
+}
+
+func TestNoRootRenewal(t *testing.T) {
+	t.Parallel()
+
+	// without a root domain the delegation check is skipped, so the certificate is still ordered
+	s := memory.New()
+	a := New(options.WithStorage(s))
+	cid, err := a.RegisterCID("id")
+	require.NoError(t, err)
+
+	ctx := cancelOnPresent(t, s, cid, "example.com")
+	_, err = a.RenewDNSContext(ctx, "id", "example.com", testClient(t, "example.com"), nil)
+	assert.NotErrorIs(t, err, NoRootError)
+	assert.ErrorIs(t, err, CanceledError, "the challenge must have been presented for the order")
+}
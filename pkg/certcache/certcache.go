@@ -0,0 +1,235 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package certcache serves the certificates obtained by Certifier
+// to crypto/tls using a tls.Config GetCertificate callback
+package certcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/logging"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNoServerName is returned when a TLS client does not send a server name (SNI)
+	ErrNoServerName = errors.New("no server name")
+
+	// ErrCertificateNotFound is returned when no certificate matches the server name sent by a TLS client
+	ErrCertificateNotFound = errors.New("certificate not found")
+)
+
+var _ storage.CertificateStorage = (*Cache)(nil)
+
+// key identifies a cached certificate
+type key struct {
+	id     string
+	domain string
+}
+
+// entry is a cached certificate
+type entry struct {
+	certificate *tls.Certificate
+	names       []string
+}
+
+// Cache wraps a storage.CertificateStorage and keeps a parsed tls.Certificate for every stored certificate,
+// so that certificates can be selected by the server name (SNI) of incoming TLS connections
+//
+// Since Cache is itself a storage.CertificateStorage, using it as the CertificateStorage for acme.ACME
+// (with options.WithCertificateStorage) means that every obtained or renewed certificate is swapped in
+// as soon as it is stored, without having to restart any TLS listeners
+type Cache struct {
+	// options contains the options used to configure this instance of Cache
+	options *options.Options
+
+	// storage is the underlying storage.CertificateStorage
+	storage storage.CertificateStorage
+
+	entries map[key]*entry
+	names   map[string]*tls.Certificate
+	mu      sync.RWMutex
+}
+
+// New creates a new instance of Cache given an underlying storage.CertificateStorage
+// and a set of configuration options
+//
+// Certificates that are already in the underlying storage are only served after calling Load
+func New(certificateStorage storage.CertificateStorage, opts ...options.Option) *Cache {
+	return &Cache{
+		options: options.LoadOptions(opts...),
+		storage: certificateStorage,
+		entries: make(map[key]*entry),
+		names:   make(map[string]*tls.Certificate),
+	}
+}
+
+// Load parses and caches all the certificates in the underlying storage
+func (c *Cache) Load() error {
+	certificates, err := c.storage.ListCertificates()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[key]*entry, len(certificates))
+	for _, certificate := range certificates {
+		e, err := parse(certificate)
+		if err != nil {
+			return err
+		}
+		entries[key{id: certificate.ID, domain: certificate.Domain}] = e
+	}
+
+	c.mu.Lock()
+	c.entries = entries
+	c.index()
+	c.mu.Unlock()
+
+	c.logger().Debugf("loaded %d certificates into cache\n", len(entries))
+	return nil
+}
+
+// SetCertificate stores a certificate in the underlying storage and
+// replaces any cached certificate for the same ID and primary domain
+func (c *Cache) SetCertificate(certificate *storage.Certificate) error {
+	e, err := parse(certificate)
+	if err != nil {
+		return err
+	}
+
+	err = c.storage.SetCertificate(certificate)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.entries[key{id: certificate.ID, domain: certificate.Domain}] = e
+	c.index()
+	c.mu.Unlock()
+
+	c.logger().Debugf("cached certificate for id '%s' and domains %q\n", certificate.ID, e.names)
+	return nil
+}
+
+// GetCertificate retrieves a certificate from the underlying storage
+func (c *Cache) GetCertificate(id string, domain string) (*storage.Certificate, bool) {
+	return c.storage.GetCertificate(id, domain)
+}
+
+// ListCertificates retrieves all the certificates from the underlying storage
+func (c *Cache) ListCertificates() ([]*storage.Certificate, error) {
+	return c.storage.ListCertificates()
+}
+
+// RemoveCertificate removes a certificate from both the underlying storage and the cache
+func (c *Cache) RemoveCertificate(id string, domain string) error {
+	err := c.storage.RemoveCertificate(id, domain)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.entries, key{id: id, domain: domain})
+	c.index()
+	c.mu.Unlock()
+	return nil
+}
+
+// GetTLSCertificate selects a cached certificate using the server name sent by a TLS client,
+// falling back to a wildcard certificate if there is no certificate for the exact server name
+//
+// It can be used as the GetCertificate callback of a tls.Config
+func (c *Cache) GetTLSCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, ErrNoServerName
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if certificate, ok := c.names[name]; ok {
+		return certificate, nil
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if certificate, ok := c.names["*"+name[i:]]; ok {
+			return certificate, nil
+		}
+	}
+
+	c.logger().Debugf("no cached certificate for server name '%s'\n", name)
+	return nil, ErrCertificateNotFound
+}
+
+// TLSConfig returns a tls.Config that serves the cached certificates
+func (c *Cache) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetTLSCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// index rebuilds the server name index of the cache, preferring the certificate that expires
+// last when multiple certificates cover the same name
+//
+// It must be called with the write lock held
+func (c *Cache) index() {
+	names := make(map[string]*tls.Certificate, len(c.names))
+	for _, e := range c.entries {
+		for _, name := range e.names {
+			if existing, ok := names[name]; !ok || e.certificate.Leaf.NotAfter.After(existing.Leaf.NotAfter) {
+				names[name] = e.certificate
+			}
+		}
+	}
+	c.names = names
+}
+
+// logger returns the logging interface for this instance of Cache
+func (c *Cache) logger() logging.Logger {
+	return c.options.Logger
+}
+
+// parse parses a stored certificate (and its issuer chain) into a tls.Certificate
+func parse(certificate *storage.Certificate) (*entry, error) {
+	chain := append(append([]byte(nil), certificate.Certificate...), certificate.IssuerCertificate...)
+	tlsCertificate, err := tls.X509KeyPair(chain, certificate.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsCertificate.Leaf == nil {
+		tlsCertificate.Leaf, err = x509.ParseCertificate(tlsCertificate.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(tlsCertificate.Leaf.DNSNames))
+	for _, name := range tlsCertificate.Leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+
+	return &entry{
+		certificate: &tlsCertificate,
+		names:       names,
+	}, nil
+}
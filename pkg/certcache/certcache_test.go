@@ -0,0 +1,109 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package certcache
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/keys"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newCertificate creates a self-signed certificate for the given domains
+func newCertificate(t *testing.T, id string, notAfter time.Time, domains ...string) *storage.Certificate {
+	privateKey, err := keys.Generate(keys.EC256)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	require.NoError(t, err)
+
+	privateKeyPEM, err := keys.PEMEncode(privateKey)
+	require.NoError(t, err)
+
+	return &storage.Certificate{
+		ID:          id,
+		Domain:      domains[0],
+		Domains:     domains,
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKey:  privateKeyPEM,
+		NotAfter:    notAfter,
+	}
+}
+
+func TestGetTLSCertificate(t *testing.T) {
+	t.Parallel()
+
+	certificateStorage := memory.NewCertificates()
+	exact := newCertificate(t, "id", time.Now().Add(time.Hour), "www.example.com")
+	require.NoError(t, certificateStorage.SetCertificate(exact))
+
+	c := New(certificateStorage)
+	_, err := c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	assert.ErrorIs(t, err, ErrCertificateNotFound)
+
+	require.NoError(t, c.Load())
+	certificate, err := c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "WWW.example.com."})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"www.example.com"}, certificate.Leaf.DNSNames)
+
+	_, err = c.GetTLSCertificate(&tls.ClientHelloInfo{})
+	assert.ErrorIs(t, err, ErrNoServerName)
+
+	wildcard := newCertificate(t, "id", time.Now().Add(time.Hour), "*.example.com", "example.com")
+	require.NoError(t, c.SetCertificate(wildcard))
+
+	certificate, err = c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, wildcard.Domains, certificate.Leaf.DNSNames)
+
+	certificate, err = c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, exact.Domains, certificate.Leaf.DNSNames)
+
+	_, err = c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "a.b.example.com"})
+	assert.ErrorIs(t, err, ErrCertificateNotFound)
+
+	// renewing the wildcard certificate should swap it in place
+	renewed := newCertificate(t, "id", time.Now().Add(time.Hour*2), "*.example.com", "example.com")
+	require.NoError(t, c.SetCertificate(renewed))
+
+	certificate, err = c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, renewed.NotAfter.Truncate(time.Second).UTC(), certificate.Leaf.NotAfter.UTC())
+
+	stored, ok := certificateStorage.GetCertificate("id", "*.example.com")
+	require.True(t, ok)
+	assert.Equal(t, renewed.Certificate, stored.Certificate)
+
+	require.NoError(t, c.RemoveCertificate("id", "*.example.com"))
+	_, err = c.GetTLSCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	assert.ErrorIs(t, err, ErrCertificateNotFound)
+}
@@ -19,17 +19,31 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"github.com/loopholelabs/certifier/pkg/options"
 	"github.com/loopholelabs/certifier/pkg/storage"
 	"github.com/loopholelabs/certifier/pkg/utils"
 	"github.com/loopholelabs/logging"
 	"github.com/miekg/dns"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	Network = "udp"
-	Mbox    = "admin."
+	UDPNetwork = "udp"
+	TCPNetwork = "tcp"
+	TLSNetwork = "tcp-tls"
+	Mbox       = "admin."
+
+	// Network is the network that DNS was served on before TCP was supported
+	//
+	// Deprecated: DNS is served on both UDPNetwork and TCPNetwork, and Network is an alias of UDPNetwork
+	Network = UDPNetwork
 
 	ShortTTL = 1
 	LongTTL  = 86400
@@ -38,6 +52,15 @@ const (
 	Expire   = 604800
 )
 
+var (
+	// InvalidTLSConfigError is returned when a DNS-over-TLS server is started without a
+	// tls.Config, or with a tls.Config that is unable to provide any certificates
+	InvalidTLSConfigError = errors.New("tls config must provide a certificate")
+
+	// NoListenersError is returned when the DNS server is started without a net.PacketConn or a net.Listener
+	NoListenersError = errors.New("no packet conn or listener given")
+)
+
 // DNS is a DNS Server designed to respond to ACME DNS-01 Challenges
 type DNS struct {
 	// options contains the options used to configure this instance of DNS
@@ -49,47 +72,317 @@ type DNS struct {
 	// public is the public domain that resolves to this DNS instance
 	public string
 
-	// server is the DNS Server for this instance of DNS
-	server *dns.Server
+	// udpServer is the UDP DNS Server for this instance of DNS, and is nil unless it has been started
+	udpServer *dns.Server
+
+	// tcpServer is the TCP DNS Server for this instance of DNS, and is nil unless it has been started
+	tcpServer *dns.Server
+
+	// tlsServer is the DNS-over-TLS Server for this instance of DNS, and is nil unless it has been started
+	tlsServer *dns.Server
+
+	// serversMu protects udpServer, tcpServer, and tlsServer
+	serversMu sync.Mutex
+
+	// ready is closed once the UDP and TCP DNS Servers are serving
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// errs receives the error that the UDP and TCP DNS Servers failed with, if they were started using StartAsync
+	errs chan error
+
+	// cookieSecret is the secret used to generate and verify DNS Cookies
+	cookieSecret []byte
 }
 
 // New creates a new instance of DNS given a set of configuration
 // options, a root domain, and a public domain that resolves to this instance of DNS
 func New(root string, public string, opts ...options.Option) *DNS {
-	return &DNS{
+	d := &DNS{
 		options: options.LoadOptions(opts...),
 		root:    dns.Fqdn(root),
 		public:  dns.Fqdn(public),
+		ready:   make(chan struct{}),
+		errs:    make(chan error, 1),
+	}
+	d.cookieSecret = d.options.CookieSecret
+	if len(d.cookieSecret) == 0 {
+		d.cookieSecret = newCookieSecret()
 	}
+	return d
 }
 
-// Start starts the DNS server on a given address addr
+// Start starts the DNS server on a given address addr for both UDP and TCP
 // and then blocks as long as the server is listening.
 func (d *DNS) Start(addr string) error {
-	d.server = &dns.Server{
-		Addr:    addr,
-		Net:     Network,
-		Handler: dns.HandlerFunc(d.handler),
+	packetConn, listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	return d.StartWithConns(packetConn, listener)
+}
+
+// StartAsync starts the DNS server on a given address addr for both UDP and TCP (as Start does),
+// but returns as soon as the server is serving instead of blocking.
+//
+// If the server fails once it has started, the error is sent to the channel returned by Errors
+func (d *DNS) StartAsync(addr string) error {
+	packetConn, listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.StartWithConns(packetConn, listener)
+	}()
+
+	select {
+	case <-d.ready:
+		go func() {
+			if err := <-errs; err != nil {
+				select {
+				case d.errs <- err:
+				default:
+				}
+			}
+		}()
+		return nil
+	case err = <-errs:
+		return err
+	}
+}
+
+// StartWithConns starts the DNS server using a net.PacketConn for UDP and a net.Listener for TCP that have
+// already been bound (for example, using systemd socket activation), and then blocks as long as the server is listening.
+//
+// Either of them can be nil to only serve DNS over the other, and both are closed once the server stops
+func (d *DNS) StartWithConns(packetConn net.PacketConn, listener net.Listener) error {
+	if packetConn == nil && listener == nil {
+		return NoListenersError
+	}
+
+	// the server is ready once both the UDP and TCP servers have started
+	var pending atomic.Int32
+	if packetConn != nil {
+		pending.Add(1)
+	}
+	if listener != nil {
+		pending.Add(1)
+	}
+	started := func() {
+		if pending.Add(-1) == 0 {
+			d.readyOnce.Do(func() {
+				close(d.ready)
+			})
+		}
+	}
+
+	d.serversMu.Lock()
+	if packetConn != nil {
+		d.udpServer = &dns.Server{
+			PacketConn:        packetConn,
+			Net:               UDPNetwork,
+			Handler:           d.handler(true),
+			NotifyStartedFunc: started,
+		}
+		d.logger().Infof("starting DNS on address %s (udp) with root domain %s\n", packetConn.LocalAddr(), d.root)
+	}
+	if listener != nil {
+		d.tcpServer = &dns.Server{
+			Listener:          listener,
+			Net:               TCPNetwork,
+			Handler:           d.handler(false),
+			NotifyStartedFunc: started,
+		}
+		d.logger().Infof("starting DNS on address %s (tcp) with root domain %s\n", listener.Addr(), d.root)
+	}
+	udpServer, tcpServer := d.udpServer, d.tcpServer
+	d.serversMu.Unlock()
+
+	return serve(udpServer, tcpServer)
+}
+
+// StartTLS starts a DNS-over-TLS (RFC 7858) server on a given address addr using the given
+// tls.Config, and then blocks as long as the server is listening.
+//
+// The DNS-over-TLS server answers the same queries as the servers started by Start, but
+// uses its own listener (usually on port 853), and is shut down along with them by Shutdown
+func (d *DNS) StartTLS(addr string, config *tls.Config) error {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return InvalidTLSConfigError
+	}
+
+	listener, err := tls.Listen(TCPNetwork, addr, config)
+	if err != nil {
+		return err
+	}
+
+	return d.StartTLSWithListener(listener)
+}
+
+// StartTLSWithListener starts a DNS-over-TLS server (as StartTLS does) using a net.Listener that has already been
+// bound, and then blocks as long as the server is listening.
+//
+// The listener must already perform the TLS handshake (for example, a listener returned by tls.NewListener),
+// and is closed once the server stops
+func (d *DNS) StartTLSWithListener(listener net.Listener) error {
+	if listener == nil {
+		return NoListenersError
+	}
+
+	server := &dns.Server{
+		Listener: listener,
+		Net:      TLSNetwork,
+		Handler:  d.handler(false),
+	}
+	d.serversMu.Lock()
+	d.tlsServer = server
+	d.serversMu.Unlock()
+
+	d.logger().Infof("starting DNS-over-TLS on address %s with root domain %s\n", listener.Addr(), d.root)
+	return server.ActivateAndServe()
+}
+
+// Ready returns a channel that is closed once the UDP and TCP DNS servers (started using
+// Start, StartAsync, or StartWithConns) are serving
+func (d *DNS) Ready() <-chan struct{} {
+	return d.ready
+}
+
+// Errors returns a channel that receives the error that the UDP and TCP DNS servers fail with after
+// they were started using StartAsync, and which receives nothing if they are shut down using Shutdown
+func (d *DNS) Errors() <-chan error {
+	return d.errs
+}
+
+// UDPAddr returns the address that the UDP DNS server is bound to (which is useful when it
+// was started using port 0), or nil if it has not been started
+func (d *DNS) UDPAddr() net.Addr {
+	d.serversMu.Lock()
+	defer d.serversMu.Unlock()
+	if d.udpServer == nil {
+		return nil
+	}
+	return d.udpServer.PacketConn.LocalAddr()
+}
+
+// TCPAddr returns the address that the TCP DNS server is bound to, or nil if it has not been started
+func (d *DNS) TCPAddr() net.Addr {
+	d.serversMu.Lock()
+	defer d.serversMu.Unlock()
+	if d.tcpServer == nil {
+		return nil
 	}
+	return d.tcpServer.Listener.Addr()
+}
 
-	d.logger().Infof("starting DNS on address %s with root domain %s\n", addr, d.root)
-	return d.server.ListenAndServe()
+// TLSAddr returns the address that the DNS-over-TLS server is bound to, or nil if it has not been started
+func (d *DNS) TLSAddr() net.Addr {
+	d.serversMu.Lock()
+	defer d.serversMu.Unlock()
+	if d.tlsServer == nil {
+		return nil
+	}
+	return d.tlsServer.Listener.Addr()
 }
 
-// Shutdown shuts the DNS server down
+// Shutdown shuts down the UDP, TCP, and DNS-over-TLS servers that have been started
 func (d *DNS) Shutdown() error {
 	d.logger().Infof("stopping DNS\n")
-	return d.server.Shutdown()
+	d.serversMu.Lock()
+	servers := []*dns.Server{d.udpServer, d.tcpServer, d.tlsServer}
+	d.serversMu.Unlock()
+
+	var errs []error
+	for _, server := range servers {
+		if server != nil {
+			errs = append(errs, server.Shutdown())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listen binds a net.PacketConn and a net.Listener to a given address addr for UDP and TCP
+func listen(addr string) (net.PacketConn, net.Listener, error) {
+	packetConn, err := net.ListenPacket(UDPNetwork, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the TCP listener is bound to the address the UDP listener resolved to,
+	// so that both of them share the same port even when addr uses port 0
+	listener, err := net.Listen(TCPNetwork, packetConn.LocalAddr().String())
+	if err != nil {
+		_ = packetConn.Close()
+		return nil, nil, err
+	}
+	return packetConn, listener, nil
 }
 
-// handler handles incoming DNS Queries
-func (d *DNS) handler(w dns.ResponseWriter, r *dns.Msg) {
+// serve runs the given UDP and TCP DNS servers (either of which may be nil) and blocks until both of them have stopped.
+//
+// If either server fails, the listeners for both are closed so that neither is left running,
+// and the first error is returned
+func serve(udpServer *dns.Server, tcpServer *dns.Server) error {
+	var servers []*dns.Server
+	for _, server := range []*dns.Server{udpServer, tcpServer} {
+		if server != nil {
+			servers = append(servers, server)
+		}
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			errs <- server.ActivateAndServe()
+		}(server)
+	}
+
+	var err error
+	for range servers {
+		if serveErr := <-errs; serveErr != nil && err == nil {
+			err = serveErr
+			if udpServer != nil {
+				_ = udpServer.PacketConn.Close()
+			}
+			if tcpServer != nil {
+				_ = tcpServer.Listener.Close()
+			}
+		}
+	}
+	return err
+}
+
+// handler returns the dns.Handler for a server, where packet is set for the server that
+// serves a net.PacketConn, since its responses must fit in the UDP payload size of the query
+func (d *DNS) handler(packet bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		d.handle(w, r, packet)
+	})
+}
+
+// handle handles incoming DNS Queries received over a packet (UDP) or stream (TCP, TLS, or HTTPS) transport
+func (d *DNS) handle(w dns.ResponseWriter, r *dns.Msg, packet bool) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
 	m.RecursionAvailable = false
 	m.Rcode = dns.RcodeNameError
 
+	opt, rcode := d.edns0(w, r)
+	if opt != nil {
+		m.Extra = append(m.Extra, opt)
+	}
+	if rcode != dns.RcodeSuccess {
+		m.Rcode = rcode
+		d.writeMsg(w, r, m, packet)
+		return
+	}
+
+	// failed is set when storage could not be read, in which case the query is refused
+	// with SERVFAIL rather than being answered as though the ID had no allowed domains
+	failed := false
 	switch r.Opcode {
 	case dns.OpcodeQuery:
 		m.Authoritative = true
@@ -98,17 +391,26 @@ func (d *DNS) handler(w dns.ResponseWriter, r *dns.Msg) {
 			question.Name = strings.ToLower(question.Name)
 			switch question.Qtype {
 			case dns.TypeTXT:
-				if ok, domain, cid := d.validTXT(question.Name); ok {
-					if challenge, ok := d.storage().GetDNSChallenge(cid, domain); ok {
-						txtRecord := d.defaultTXT(question.Name)
-						txtRecord.Txt = []string{challenge}
-						d.logger().Infof("received TXT query for valid CID '%s' and domain '%s' (ID %d), responding with '%s'\n", cid, domain, r.Id, challenge)
-						m.Answer = append(m.Answer, txtRecord)
+				if ok, label, cid := d.validTXT(question.Name); ok {
+					if id, cids, ok := d.resolveCID(cid); !ok {
+						d.logger().Warnf("received TXT query for unregistered or revoked CID '%s' and label '%s' (ID %d)\n", cid, label, r.Id)
+					} else if allowed, err := d.allowed(id, label); err != nil {
+						d.logger().Errorf("unable to check whether label '%s' is allowed for CID '%s' (ID %d): %s\n", label, cid, r.Id, err)
+						failed = true
+					} else if !allowed {
+						d.logger().Warnf("received TXT query for CID '%s' and label '%s' which is not allowed (ID %d)\n", cid, label, r.Id)
+					} else if challenges := d.challenges(cids, label); len(challenges) > 0 {
+						for _, challenge := range challenges {
+							txtRecord := d.defaultTXT(question.Name)
+							txtRecord.Txt = []string{challenge}
+							m.Answer = append(m.Answer, txtRecord)
+						}
+						d.logger().Infof("received TXT query for valid CID '%s' and label '%s' (ID %d), responding with %q\n", cid, label, r.Id, challenges)
 					} else {
-						d.logger().Warnf("received TXT query for unknown CID '%s' and domain '%s' (ID %d)\n", cid, domain, r.Id)
+						d.logger().Warnf("received TXT query for CID '%s' and label '%s' without any challenges (ID %d)\n", cid, label, r.Id)
 					}
 				} else {
-					d.logger().Warnf("received TXT query for invalid cid/domain '%s' (ID %d)\n", question.Name, r.Id)
+					d.logger().Warnf("received TXT query for invalid cid/label '%s' (ID %d)\n", question.Name, r.Id)
 				}
 			case dns.TypeNS:
 				if d.validNS(question.Name) {
@@ -138,10 +440,30 @@ func (d *DNS) handler(w dns.ResponseWriter, r *dns.Msg) {
 		m.Rcode = dns.RcodeRefused
 	}
 
-	if len(m.Answer) > 0 {
+	switch {
+	case failed:
+		m.Answer = nil
+		m.Rcode = dns.RcodeServerFailure
+	case len(m.Answer) > 0:
 		m.Rcode = dns.RcodeSuccess
 	}
 
+	d.writeMsg(w, r, m, packet)
+}
+
+// writeMsg writes a response to a query, truncating it (and setting its TC bit) if the query was received over
+// a packet transport and the response does not fit in the UDP payload size of the query, so that the client retries over TCP
+//
+// The transport is given by the server rather than derived from the address of the client,
+// since a net.PacketConn passed to StartWithConns does not necessarily use UDP addresses
+func (d *DNS) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, packet bool) {
+	if packet {
+		m.Truncate(udpSize(r))
+		if m.Truncated {
+			d.logger().Debugf("truncated response to query (ID %d) to %d bytes\n", r.Id, udpSize(r))
+		}
+	}
+
 	err := w.WriteMsg(m)
 	if err != nil {
 		d.logger().Errorf("error writing DNS response: %s\n", err)
@@ -149,14 +471,91 @@ func (d *DNS) handler(w dns.ResponseWriter, r *dns.Msg) {
 }
 
 // validTXT checks whether the given domain is valid for returning TXT Records
-// and also returns the subdomain and the CID (in that order)
+// and also returns the label of the domain the challenge is for and the CID (in that order)
+//
+// The label must be one that utils.EncodeDomain could have returned, unless legacy labels are enabled
 func (d *DNS) validTXT(domain string) (bool, string, string) {
 	if qualifiers := strings.SplitN(domain, ".", 3); len(qualifiers) == 3 && qualifiers[2] == d.root {
-		return true, qualifiers[0], qualifiers[1]
+		if utils.ValidLabel(qualifiers[0]) || (d.options.LegacyLabels && len(qualifiers[0]) <= utils.MaxLabelLength) {
+			return true, qualifiers[0], qualifiers[1]
+		}
 	}
 	return false, "", ""
 }
 
+// resolveCID checks whether the given CID is currently registered, or has been rotated but is still within
+// its grace period, and returns the ID it was registered for along with the CIDs whose challenges should be served
+//
+// Certificates for an ID are always requested using its current CID, so the challenges for a rotated
+// CID include those of the current CID for the same ID, which lets users whose _acme-challenge
+// CNAME still points at the rotated CID keep obtaining certificates during the grace period
+func (d *DNS) resolveCID(cid string) (string, []string, bool) {
+	if id, ok := d.storage().GetID(cid); ok {
+		return id, []string{cid}, true
+	}
+	retired, ok := d.storage().GetRetiredCID(cid)
+	if !ok || !time.Now().Before(retired.Until) {
+		return "", nil, false
+	}
+	if current, ok := d.storage().GetCID(retired.ID); ok {
+		return retired.ID, []string{cid, current}, true
+	}
+	return retired.ID, []string{cid}, true
+}
+
+// allowed checks whether the domain that the given label encodes is matched by the allowed domains of the given ID
+//
+// Since the DNS-01 Challenge for a wildcard domain is performed against its base domain,
+// a wildcard pattern (*.example.com) also allows the challenges of its base domain (example.com)
+//
+// Hashed labels cannot be decoded, so they are only allowed if the domain that was recorded
+// for them when their challenges were presented (see storage.Storage.SetHashedLabel) is allowed
+//
+// An error is returned if the allowed domains or the hashed label could not be read from storage,
+// so that a failing storage never causes the ID to be treated as unrestricted
+func (d *DNS) allowed(id string, label string) (bool, error) {
+	patterns, ok, err := storage.GetAllowedDomainsContext(context.Background(), d.storage(), id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+	if !ok {
+		return !d.options.RequireAllowedDomains, nil
+	}
+	if utils.IsHashedLabel(label) {
+		domain, ok, err := storage.GetHashedLabelContext(context.Background(), d.storage(), label)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return false, err
+		}
+		return ok && utils.EncodeDomain(domain) == label && (utils.DomainAllowed(patterns, domain) || utils.DomainAllowed(patterns, utils.JoinStrings("*.", domain))), nil
+	}
+	if domain, ok := utils.DecodeLabel(label); ok && (utils.DomainAllowed(patterns, domain) || utils.DomainAllowed(patterns, utils.JoinStrings("*.", domain))) {
+		return true, nil
+	}
+	if !d.options.LegacyLabels {
+		return false, nil
+	}
+	for _, pattern := range patterns {
+		base := utils.NormalizeDomain(strings.ToLower(strings.TrimSuffix(utils.TrimWildcard(pattern), ".")))
+		if label == base {
+			return true, nil
+		}
+		if utils.TrimWildcard(pattern) != pattern && strings.HasSuffix(label, utils.JoinStrings("-", base)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// challenges returns the DNS challenges for the given label across all the given CIDs
+func (d *DNS) challenges(cids []string, label string) (challenges []string) {
+	for _, cid := range cids {
+		if c, ok := d.storage().GetDNSChallenges(cid, label); ok {
+			challenges = append(challenges, c...)
+		}
+	}
+	return
+}
+
 // defaultTXT returns a TXT Record with the defaults filled in
 func (d *DNS) defaultTXT(domain string) *dns.TXT {
 	return &dns.TXT{
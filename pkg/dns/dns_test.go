@@ -17,10 +17,26 @@
 package dns
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/loopholelabs/certifier/internal/memory"
 	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -34,7 +50,8 @@ func TestNew(t *testing.T) {
 	d := New(rootDomain, publicDomain)
 	assert.Equal(t, dns.Fqdn(rootDomain), d.root)
 	assert.Equal(t, dns.Fqdn(publicDomain), d.public)
-	assert.Nil(t, d.server)
+	assert.Nil(t, d.udpServer)
+	assert.Nil(t, d.tcpServer)
 
 	assert.Equal(t, options.DefaultLogger, d.options.Logger)
 	assert.Equal(t, options.DefaultStorage, d.options.Storage)
@@ -146,3 +163,388 @@ func TestSOA(t *testing.T) {
 		assert.True(t, ok)
 	})
 }
+
+// responseWriter is a dns.ResponseWriter that records the message written to it,
+// and that behaves as a UDP connection unless tcp is set
+type responseWriter struct {
+	msg *dns.Msg
+	tcp bool
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	if w.tcp {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *responseWriter) RemoteAddr() net.Addr {
+	if w.tcp {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *responseWriter) Write([]byte) (int, error) { return 0, nil }
+func (w *responseWriter) Close() error              { return nil }
+func (w *responseWriter) TsigStatus() error         { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)       {}
+func (w *responseWriter) Hijack()                   {}
+
+func TestHandlerTXT(t *testing.T) {
+	t.Parallel()
+
+	storage := memory.New()
+	d := New(rootDomain, publicDomain, options.WithStorage(storage))
+	name := dns.Fqdn("testdomain.cid." + rootDomain)
+
+	query := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeTXT)
+		w := new(responseWriter)
+		d.handle(w, r, true)
+		require.NotNil(t, w.msg)
+		return w.msg
+	}
+
+	m := query()
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Empty(t, m.Answer)
+
+	require.NoError(t, storage.SetDNSChallenge("cid", "testdomain", "first"))
+	require.NoError(t, storage.SetDNSChallenge("cid", "testdomain", "second"))
+
+	// challenges are only served for registered CIDs
+	m = query()
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Empty(t, m.Answer)
+
+	require.NoError(t, storage.SetCID("id", "cid"))
+
+	m = query()
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	require.Len(t, m.Answer, 2)
+	assert.Equal(t, []string{"first"}, m.Answer[0].(*dns.TXT).Txt)
+	assert.Equal(t, []string{"second"}, m.Answer[1].(*dns.TXT).Txt)
+
+	require.NoError(t, storage.RemoveDNSChallenge("cid", "testdomain", "first"))
+
+	m = query()
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, []string{"second"}, m.Answer[0].(*dns.TXT).Txt)
+}
+
+func TestHandlerTXTRetiredCID(t *testing.T) {
+	t.Parallel()
+
+	storage := memory.New()
+	d := New(rootDomain, publicDomain, options.WithStorage(storage))
+
+	query := func(cid string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn("testdomain."+cid+"."+rootDomain), dns.TypeTXT)
+		w := new(responseWriter)
+		d.handle(w, r, true)
+		require.NotNil(t, w.msg)
+		return w.msg
+	}
+
+	require.NoError(t, storage.RetireCID("grace", "id", time.Now().Add(time.Hour)))
+	require.NoError(t, storage.SetDNSChallenge("grace", "testdomain", "challenge"))
+	require.NoError(t, storage.RetireCID("expired", "id", time.Now().Add(-time.Second)))
+	require.NoError(t, storage.SetDNSChallenge("expired", "testdomain", "challenge"))
+
+	m := query("grace")
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	require.Len(t, m.Answer, 1)
+
+	// challenges presented using the current CID are served for CIDs that are within their grace period
+	require.NoError(t, storage.SetCID("id", "current"))
+	require.NoError(t, storage.SetDNSChallenge("current", "testdomain", "renewed"))
+
+	m = query("grace")
+	require.Len(t, m.Answer, 2)
+	assert.Equal(t, []string{"challenge"}, m.Answer[0].(*dns.TXT).Txt)
+	assert.Equal(t, []string{"renewed"}, m.Answer[1].(*dns.TXT).Txt)
+
+	m = query("expired")
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Empty(t, m.Answer)
+}
+
+func TestHandlerTXTAllowedDomains(t *testing.T) {
+	t.Parallel()
+
+	storage := memory.New()
+	d := New(rootDomain, publicDomain, options.WithStorage(storage))
+
+	query := func(label string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(label+".cid."+rootDomain), dns.TypeTXT)
+		w := new(responseWriter)
+		d.handle(w, r, true)
+		require.NotNil(t, w.msg)
+		return w.msg
+	}
+
+	require.NoError(t, storage.SetCID("id", "cid"))
+	require.NoError(t, storage.SetAllowedDomains("id", []string{"example.com", "*.example.org", "my-site.com"}))
+	long := strings.Repeat("a", 63)
+	hashed := utils.HashedLabel(long + ".example.org")
+	require.NoError(t, storage.SetHashedLabel(hashed, long+".example.org"))
+
+	// a hashed label is only allowed for the domain that was recorded for it, even with wildcard patterns
+	victim := utils.HashedLabel(long + ".victim.com")
+	require.NoError(t, storage.SetHashedLabel(victim, long+".victim.com"))
+	forged := utils.HashedLabel(long + ".forged.com")
+	require.NoError(t, storage.SetHashedLabel(forged, long+".example.org"))
+	unknown := utils.HashedLabel(long + ".unknown.org")
+
+	for _, label := range []string{"example-com", "example-org", "a-example-org", "other-com", "a-example-com", "my--site-com", "my-site-com", "a---b-com", hashed, victim, forged, unknown} {
+		require.NoError(t, storage.SetDNSChallenge("cid", label, "challenge"))
+	}
+
+	for label, allowed := range map[string]bool{
+		"example-com":   true,
+		"example-org":   true,
+		"a-example-org": true,
+		"other-com":     false,
+		"a-example-com": false,
+		"my--site-com":  true,
+		"my-site-com":   false,
+		"a---b-com":     false,
+		hashed:          true,
+		victim:          false,
+		forged:          false,
+		unknown:         false,
+	} {
+		m := query(label)
+		if allowed {
+			assert.Len(t, m.Answer, 1, label)
+		} else {
+			assert.Empty(t, m.Answer, label)
+			assert.Equal(t, dns.RcodeNameError, m.Rcode, label)
+		}
+	}
+
+	// the legacy label of my-site.com is only allowed once legacy labels are enabled
+	d = New(rootDomain, publicDomain, options.WithStorage(storage), options.WithLegacyLabels(true))
+	assert.Len(t, query("my-site-com").Answer, 1)
+}
+
+// failingStorage is a storage.ContextStorage that registers every CID for the ID "id", and fails to read
+// the allowed domains of the ID (or the hashed labels, if patterns is set)
+type failingStorage struct {
+	storage.ContextStorage
+	patterns []string
+}
+
+func (s *failingStorage) GetID(string) (string, bool) {
+	return "id", true
+}
+
+func (s *failingStorage) GetAllowedDomainsContext(context.Context, string) ([]string, bool, error) {
+	if s.patterns != nil {
+		return s.patterns, true, nil
+	}
+	return nil, false, errors.New("allowed domains unavailable")
+}
+
+func (s *failingStorage) GetHashedLabelContext(context.Context, string) (string, bool, error) {
+	return "", false, errors.New("hashed labels unavailable")
+}
+
+func TestHandlerTXTStorageFailure(t *testing.T) {
+	t.Parallel()
+
+	query := func(s storage.Storage, label string) *dns.Msg {
+		d := New(rootDomain, publicDomain, options.WithStorage(s))
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(label+".cid."+rootDomain), dns.TypeTXT)
+		w := new(responseWriter)
+		d.handle(w, r, true)
+		require.NotNil(t, w.msg)
+		return w.msg
+	}
+
+	// a storage failure must never cause the ID to be treated as if it had no allowed domains
+	m := query(&failingStorage{}, "example-com")
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+	assert.Empty(t, m.Answer)
+
+	m = query(&failingStorage{patterns: []string{"*.example.org"}}, utils.HashedLabel(strings.Repeat("a", 63)+".example.org"))
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+	assert.Empty(t, m.Answer)
+}
+
+// selfSignedCertificate generates a self-signed certificate for the given DNS name
+func selfSignedCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestStartTLS(t *testing.T) {
+	t.Parallel()
+
+	d := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+	assert.ErrorIs(t, d.StartTLS("127.0.0.1:0", nil), InvalidTLSConfigError)
+	assert.ErrorIs(t, d.StartTLS("127.0.0.1:0", new(tls.Config)), InvalidTLSConfigError)
+
+	certificate := selfSignedCertificate(t, publicDomain)
+	listener, err := tls.Listen(TCPNetwork, "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.StartTLSWithListener(listener)
+	}()
+	require.Eventually(t, func() bool {
+		return d.TLSAddr() != nil
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, listener.Addr(), d.TLSAddr())
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &dns.Client{Net: TLSNetwork, TLSConfig: &tls.Config{RootCAs: roots, ServerName: publicDomain}}
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+	m, _, err := client.Exchange(r, listener.Addr().String())
+	require.NoError(t, err)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, dns.Fqdn(publicDomain), m.Answer[0].(*dns.NS).Ns)
+
+	require.NoError(t, d.Shutdown())
+	select {
+	case err = <-errs:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("DNS-over-TLS server did not stop")
+	}
+}
+
+func TestStartWithConns(t *testing.T) {
+	t.Parallel()
+
+	d := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+	assert.ErrorIs(t, d.StartWithConns(nil, nil), NoListenersError)
+	assert.Nil(t, d.UDPAddr())
+	assert.Nil(t, d.TCPAddr())
+	assert.Nil(t, d.TLSAddr())
+
+	packetConn, err := net.ListenPacket(UDPNetwork, "127.0.0.1:0")
+	require.NoError(t, err)
+	listener, err := net.Listen(TCPNetwork, "127.0.0.1:0")
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.StartWithConns(packetConn, listener)
+	}()
+	select {
+	case <-d.Ready():
+	case <-time.After(time.Second * 5):
+		t.Fatal("DNS server did not become ready")
+	}
+	assert.Equal(t, packetConn.LocalAddr(), d.UDPAddr())
+	assert.Equal(t, listener.Addr(), d.TCPAddr())
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+	for network, addr := range map[string]net.Addr{UDPNetwork: d.UDPAddr(), TCPNetwork: d.TCPAddr()} {
+		client := &dns.Client{Net: network}
+		var m *dns.Msg
+		require.Eventually(t, func() bool {
+			m, _, err = client.Exchange(r, addr.String())
+			return err == nil
+		}, time.Second*5, time.Millisecond*10, network)
+		assert.Len(t, m.Answer, 1, network)
+	}
+
+	require.NoError(t, d.Shutdown())
+	select {
+	case err = <-errs:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("DNS server did not stop")
+	}
+}
+
+func TestStartAsync(t *testing.T) {
+	t.Parallel()
+
+	d := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+	require.NoError(t, d.StartAsync("127.0.0.1:0"))
+	select {
+	case <-d.Ready():
+	default:
+		t.Fatal("DNS server must be ready once StartAsync returns")
+	}
+	assert.Equal(t, d.UDPAddr().String(), d.TCPAddr().String())
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+	m, _, err := new(dns.Client).Exchange(r, d.UDPAddr().String())
+	require.NoError(t, err)
+	assert.Len(t, m.Answer, 1)
+
+	// the address is already in use, so binding fails before StartAsync returns
+	other := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+	assert.Error(t, other.StartAsync(d.TCPAddr().String()))
+
+	require.NoError(t, d.Shutdown())
+	select {
+	case err = <-d.Errors():
+		t.Fatalf("unexpected error after shutting down: %s", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestStart(t *testing.T) {
+	t.Parallel()
+
+	d := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.Start("127.0.0.1:0")
+	}()
+	select {
+	case <-d.Ready():
+	case err := <-errs:
+		t.Fatalf("DNS server failed to start: %s", err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("DNS server did not become ready")
+	}
+	assert.Equal(t, d.UDPAddr().String(), d.TCPAddr().String(), "the UDP and TCP servers must share an address")
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+	for _, network := range []string{UDPNetwork, TCPNetwork} {
+		m, _, err := (&dns.Client{Net: network}).Exchange(r, d.UDPAddr().String())
+		require.NoError(t, err, network)
+		require.Len(t, m.Answer, 1, network)
+		assert.Equal(t, dns.Fqdn(publicDomain), m.Answer[0].(*dns.NS).Ns, network)
+	}
+
+	require.NoError(t, d.Shutdown())
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("DNS server did not stop")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/base64"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DoHContentType is the media type of the DNS messages that are sent and received over DNS-over-HTTPS
+	DoHContentType = "application/dns-message"
+
+	// DoHQueryParameter is the query parameter that contains the DNS message of a DNS-over-HTTPS GET request
+	DoHQueryParameter = "dns"
+
+	// MaxDoHMessageSize is the maximum size of a DNS message received over DNS-over-HTTPS
+	MaxDoHMessageSize = dns.MaxMsgSize
+)
+
+var _ http.Handler = (*dohHandler)(nil)
+var _ dns.ResponseWriter = (*dohResponseWriter)(nil)
+
+// DoHHandler returns an http.Handler that answers DNS-over-HTTPS (RFC 8484) queries for this instance of DNS,
+// so that it can be mounted on an existing HTTPS server (usually at /dns-query)
+//
+// Both GET requests (with a base64url encoded DNS message in the dns query parameter) and
+// POST requests (with a DNS message body) are supported, and the queries are answered in the same
+// way as the queries received by the servers started by Start
+func (d *DNS) DoHHandler() http.Handler {
+	return &dohHandler{dns: d}
+}
+
+// dohHandler serves DNS-over-HTTPS requests using the handler of a DNS instance
+type dohHandler struct {
+	dns *DNS
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		// RFC 8484 messages are unpadded, but padded messages are also accepted
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get(DoHQueryParameter), "="))
+		if err != nil || len(data) == 0 {
+			http.Error(w, "invalid or missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); !strings.EqualFold(strings.TrimSpace(strings.Split(contentType, ";")[0]), DoHContentType) {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, MaxDoHMessageSize+1))
+		if err != nil {
+			http.Error(w, "unable to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(data) > MaxDoHMessageSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err = req.Unpack(data); err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{remoteAddr: r.RemoteAddr}
+	h.dns.handle(rw, req, false)
+	if rw.msg == nil {
+		http.Error(w, "no DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	data, err = rw.msg.Pack()
+	if err != nil {
+		h.dns.logger().Errorf("error packing DNS-over-HTTPS response: %s\n", err)
+		http.Error(w, "unable to pack DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHContentType)
+	w.Header().Set("Cache-Control", utils.JoinStrings("max-age=", strconv.FormatUint(uint64(minTTL(rw.msg)), 10)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
+
+// minTTL returns the lowest TTL of the records in the answer and authority sections of a DNS message,
+// which is the freshness lifetime of a DNS-over-HTTPS response (RFC 8484 section 5.1), or zero if there are none
+func minTTL(m *dns.Msg) (ttl uint32) {
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return
+}
+
+// dohResponseWriter is the dns.ResponseWriter that DNS-over-HTTPS queries are
+// answered with, which records the message written to it
+type dohResponseWriter struct {
+	remoteAddr string
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	addr, err := netip.ParseAddrPort(w.remoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addr)
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(data []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(data), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,94 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDoHHandler(t *testing.T) {
+	t.Parallel()
+
+	storage := memory.New()
+	require.NoError(t, storage.SetCID("id", "cid"))
+	require.NoError(t, storage.SetDNSChallenge("cid", "example-com", "challenge"))
+
+	server := httptest.NewServer(New(rootDomain, publicDomain, options.WithStorage(storage)).DoHHandler())
+	t.Cleanup(server.Close)
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn("example-com.cid."+rootDomain), dns.TypeTXT)
+	r.Id = 0
+	query, err := r.Pack()
+	require.NoError(t, err)
+
+	check := func(resp *http.Response) {
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, DoHContentType, resp.Header.Get("Content-Type"))
+		assert.Equal(t, "max-age=1", resp.Header.Get("Cache-Control"))
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		m := new(dns.Msg)
+		require.NoError(t, m.Unpack(data))
+		require.Len(t, m.Answer, 1)
+		assert.Equal(t, []string{"challenge"}, m.Answer[0].(*dns.TXT).Txt)
+	}
+
+	resp, err := http.Get(server.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	require.NoError(t, err)
+	check(resp)
+
+	resp, err = http.Post(server.URL, DoHContentType, bytes.NewReader(query))
+	require.NoError(t, err)
+	check(resp)
+
+	for _, c := range []struct {
+		method      string
+		url         string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{http.MethodGet, server.URL, "", nil, http.StatusBadRequest},
+		{http.MethodGet, server.URL + "?dns=!", "", nil, http.StatusBadRequest},
+		{http.MethodPost, server.URL, "text/plain", query, http.StatusUnsupportedMediaType},
+		{http.MethodPost, server.URL, DoHContentType, []byte("invalid"), http.StatusBadRequest},
+		{http.MethodPut, server.URL, DoHContentType, query, http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(c.method, c.url, bytes.NewReader(c.body))
+		require.NoError(t, err)
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, c.status, resp.StatusCode, "%s %s", c.method, c.url)
+	}
+}
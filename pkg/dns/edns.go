@@ -0,0 +1,166 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+const (
+	// MaxUDPSize is the UDP payload size that is advertised in EDNS0 responses, which is also
+	// the largest UDP response that is sent regardless of the payload size advertised by the client
+	MaxUDPSize = 1232
+
+	// ClientCookieSize is the size of a client DNS Cookie
+	ClientCookieSize = 8
+
+	// ServerCookieSize is the size of the server DNS Cookies that are generated, using the layout of
+	// RFC 9018 (a version, three reserved bytes, a timestamp, and an 8 byte hash)
+	ServerCookieSize = 16
+
+	// CookieRefresh is the age after which a server DNS Cookie that is sent by a client is replaced with a new one
+	CookieRefresh = time.Minute * 30
+
+	// cookieVersion is the version of the server DNS Cookies that are generated
+	cookieVersion = 1
+
+	// cookieClockSkew is how far into the future the timestamp of a server DNS Cookie may be
+	cookieClockSkew = time.Minute * 5
+
+	// minServerCookieSize and maxServerCookieSize are the sizes that server DNS Cookies may have (RFC 7873 section 4)
+	minServerCookieSize = 8
+	maxServerCookieSize = 32
+)
+
+// edns0 negotiates EDNS0 (RFC 6891) for a query, returning the OPT record that must be added to the
+// response (or nil if the query does not use EDNS0) along with the rcode that the response must use
+// instead of answering the query, or dns.RcodeSuccess if the query should be answered
+//
+// If the query contains a DNS Cookie (RFC 7873), the OPT record contains the client cookie along
+// with a server cookie, and a malformed cookie results in a dns.RcodeFormatError response
+func (d *DNS) edns0(w dns.ResponseWriter, r *dns.Msg) (*dns.OPT, int) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, dns.RcodeSuccess
+	}
+
+	// DNSSEC is not supported, so the DO bit is never set in the response
+	res := new(dns.OPT)
+	res.Hdr.Name = "."
+	res.Hdr.Rrtype = dns.TypeOPT
+	res.SetUDPSize(MaxUDPSize)
+
+	if opt.Version() != 0 {
+		d.logger().Warnf("received query with unsupported EDNS version %d (ID %d)\n", opt.Version(), r.Id)
+		return res, dns.RcodeBadVers
+	}
+
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		data, err := hex.DecodeString(cookie.Cookie)
+		if err != nil || (len(data) != ClientCookieSize && (len(data) < ClientCookieSize+minServerCookieSize || len(data) > ClientCookieSize+maxServerCookieSize)) {
+			d.logger().Warnf("received query with malformed DNS cookie (ID %d)\n", r.Id)
+			return res, dns.RcodeFormatError
+		}
+
+		client, server := data[:ClientCookieSize], data[ClientCookieSize:]
+		now := time.Now()
+		if len(server) == 0 || !d.validCookie(client, server, w.RemoteAddr(), now) {
+			if len(server) > 0 {
+				d.logger().Debugf("received query with invalid or expired server DNS cookie (ID %d)\n", r.Id)
+			}
+			server = d.serverCookie(client, w.RemoteAddr(), now)
+		}
+		res.Option = append(res.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(append(append([]byte(nil), client...), server...)),
+		})
+		break
+	}
+
+	return res, dns.RcodeSuccess
+}
+
+// serverCookie generates a server DNS Cookie for a client cookie and the address of the client at the given time
+func (d *DNS) serverCookie(client []byte, addr net.Addr, now time.Time) []byte {
+	cookie := make([]byte, ServerCookieSize)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+	copy(cookie[8:], d.cookieHash(client, cookie[:8], addr))
+	return cookie
+}
+
+// validCookie checks whether a server DNS Cookie was generated by this instance of DNS for a client cookie
+// and the address of the client, and that it is neither expired nor due to be refreshed at the given time
+func (d *DNS) validCookie(client []byte, server []byte, addr net.Addr, now time.Time) bool {
+	if len(server) != ServerCookieSize || server[0] != cookieVersion {
+		return false
+	}
+	if !hmac.Equal(server[8:], d.cookieHash(client, server[:8], addr)) {
+		return false
+	}
+	generated := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	return now.Sub(generated) < CookieRefresh && generated.Sub(now) < cookieClockSkew
+}
+
+// cookieHash returns the hash of a server DNS Cookie given the client cookie, the first
+// 8 bytes of the server cookie (its version, reserved bytes, and timestamp), and the address of the client
+func (d *DNS) cookieHash(client []byte, header []byte, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, d.cookieSecret)
+	mac.Write(client)
+	mac.Write(header)
+	mac.Write(remoteIP(addr))
+	return mac.Sum(nil)[:ServerCookieSize-8]
+}
+
+// udpSize returns the largest UDP response that can be sent for a query, which is the UDP payload
+// size advertised by its OPT record (between dns.MinMsgSize and MaxUDPSize), or dns.MinMsgSize without EDNS0
+func udpSize(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	return min(max(int(opt.UDPSize()), dns.MinMsgSize), MaxUDPSize)
+}
+
+// remoteIP returns the IP address of the given address of a client, or nil if it does not have one
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.To16()
+	case *net.TCPAddr:
+		return a.IP.To16()
+	}
+	return nil
+}
+
+// newCookieSecret generates a random secret for DNS Cookies
+func newCookieSecret() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}
@@ -0,0 +1,166 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// exchange sends a query to the handler of a DNS instance and returns the response after packing and unpacking it
+func exchange(t *testing.T, d *DNS, r *dns.Msg, tcp bool) *dns.Msg {
+	w := &responseWriter{tcp: tcp}
+	d.handle(w, r, !tcp)
+	require.NotNil(t, w.msg)
+	data, err := w.msg.Pack()
+	require.NoError(t, err)
+	if !tcp {
+		assert.LessOrEqual(t, len(data), MaxUDPSize)
+	}
+	m := new(dns.Msg)
+	require.NoError(t, m.Unpack(data))
+	return m
+}
+
+// cookie returns the DNS Cookie in the OPT record of a message
+func cookie(t *testing.T, m *dns.Msg) []byte {
+	opt := m.IsEdns0()
+	require.NotNil(t, opt)
+	for _, option := range opt.Option {
+		if c, ok := option.(*dns.EDNS0_COOKIE); ok {
+			data, err := hex.DecodeString(c.Cookie)
+			require.NoError(t, err)
+			return data
+		}
+	}
+	return nil
+}
+
+func TestEDNS0(t *testing.T) {
+	t.Parallel()
+
+	d := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+	m := exchange(t, d, r, false)
+	assert.Nil(t, m.IsEdns0(), "responses to queries without EDNS0 must not contain an OPT record")
+	assert.Len(t, m.Answer, 1)
+
+	r.SetEdns0(4096, true)
+	m = exchange(t, d, r, false)
+	require.NotNil(t, m.IsEdns0())
+	assert.Equal(t, uint16(MaxUDPSize), m.IsEdns0().UDPSize())
+	assert.False(t, m.IsEdns0().Do())
+	assert.Nil(t, cookie(t, m))
+	assert.Len(t, m.Answer, 1)
+
+	r.IsEdns0().SetVersion(1)
+	m = exchange(t, d, r, false)
+	assert.Equal(t, dns.RcodeBadVers, m.Rcode)
+	assert.Empty(t, m.Answer)
+}
+
+func TestDNSCookies(t *testing.T) {
+	t.Parallel()
+
+	d := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+
+	query := func(c string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c})
+		return exchange(t, d, r, false)
+	}
+
+	const client = "0102030405060708"
+	m := query(client)
+	assert.Len(t, m.Answer, 1)
+	first := cookie(t, m)
+	require.Len(t, first, ClientCookieSize+ServerCookieSize)
+	assert.Equal(t, client, hex.EncodeToString(first[:ClientCookieSize]))
+
+	// a valid server cookie is returned as is
+	m = query(hex.EncodeToString(first))
+	assert.Len(t, m.Answer, 1)
+	assert.Equal(t, first, cookie(t, m))
+
+	// an invalid server cookie is replaced, but the query is still answered
+	tampered := append([]byte(nil), first...)
+	tampered[len(tampered)-1] ^= 0xFF
+	m = query(hex.EncodeToString(tampered))
+	assert.Len(t, m.Answer, 1)
+	assert.Equal(t, first, cookie(t, m))
+
+	// server cookies are only valid for the instance (or the secret) that generated them
+	other := New(rootDomain, publicDomain, options.WithStorage(memory.New()))
+	w := new(responseWriter)
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(rootDomain), dns.TypeNS)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(first)})
+	other.handle(w, r, true)
+	assert.NotEqual(t, first, cookie(t, w.msg))
+
+	for _, malformed := range []string{"01020304", client + "0102", client + strings.Repeat("00", 33)} {
+		m = query(malformed)
+		assert.Equal(t, dns.RcodeFormatError, m.Rcode, malformed)
+		assert.Empty(t, m.Answer, malformed)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	t.Parallel()
+
+	storage := memory.New()
+	require.NoError(t, storage.SetCID("id", "cid"))
+	for i := 0; i < 30; i++ {
+		require.NoError(t, storage.SetDNSChallenge("cid", "example-com", fmt.Sprintf("challenge-%02d-%s", i, strings.Repeat("x", 32))))
+	}
+	d := New(rootDomain, publicDomain, options.WithStorage(storage))
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn("example-com.cid."+rootDomain), dns.TypeTXT)
+
+	m := exchange(t, d, r, false)
+	assert.True(t, m.Truncated)
+	assert.Less(t, len(m.Answer), 30)
+
+	r.SetEdns0(4096, false)
+	m = exchange(t, d, r, false)
+	assert.True(t, m.Truncated, "UDP responses must never be larger than MaxUDPSize")
+	assert.Less(t, len(m.Answer), 30)
+	assert.NotNil(t, m.IsEdns0(), "truncated responses must keep their OPT record")
+
+	m = exchange(t, d, r, true)
+	assert.False(t, m.Truncated, "TCP responses must never be truncated")
+	assert.Len(t, m.Answer, 30)
+
+	// truncation depends on the transport of the server, not on the type of the client's address
+	w := &responseWriter{tcp: true}
+	d.handle(w, r, true)
+	require.NotNil(t, w.msg)
+	assert.True(t, w.msg.Truncated, "packet responses must be truncated regardless of the client's address")
+}
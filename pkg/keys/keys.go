@@ -0,0 +1,101 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package keys generates and encodes the private keys
+// used for the certificates that Certifier obtains
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+var (
+	// ErrInvalidType is returned when an unknown key Type is requested
+	ErrInvalidType = errors.New("invalid key type")
+
+	// ErrUnsupportedKey is returned when a private key of an unsupported algorithm is encoded
+	ErrUnsupportedKey = errors.New("unsupported private key")
+)
+
+// Type is the algorithm (and key size or curve) of a private key
+type Type string
+
+const (
+	EC256   Type = "P256"
+	EC384   Type = "P384"
+	RSA2048 Type = "2048"
+	RSA3072 Type = "3072"
+	RSA4096 Type = "4096"
+	Ed25519 Type = "Ed25519"
+)
+
+// Generate generates a new private key of the given Type
+func Generate(t Type) (crypto.Signer, error) {
+	switch t {
+	case EC256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	}
+	return nil, ErrInvalidType
+}
+
+// PEMEncode encodes a private key as a PEM block
+//
+// RSA and ECDSA keys use the same PKCS #1 and SEC 1 encodings as lego, while
+// Ed25519 keys (which have no algorithm-specific encoding) use PKCS #8
+//
+// ErrUnsupportedKey is returned for any other crypto.Signer, including keys that
+// cannot be exported (such as keys held in a KMS or an HSM)
+func PEMEncode(privateKey crypto.Signer) ([]byte, error) {
+	var block *pem.Block
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
+	case ed25519.PrivateKey:
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	return pem.EncodeToMemory(block), nil
+}
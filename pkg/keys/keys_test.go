@@ -0,0 +1,93 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// opaqueSigner is a crypto.Signer whose private key cannot be exported, like a key held in a KMS or an HSM
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestGeneratePEMEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		keyType   Type
+		blockType string
+		parse     func([]byte) (any, error)
+		check     func(t *testing.T, key any)
+	}{
+		{EC256, "EC PRIVATE KEY", func(b []byte) (any, error) { return x509.ParseECPrivateKey(b) }, func(t *testing.T, key any) {
+			assert.Equal(t, elliptic.P256(), key.(*ecdsa.PrivateKey).Curve)
+		}},
+		{EC384, "EC PRIVATE KEY", func(b []byte) (any, error) { return x509.ParseECPrivateKey(b) }, func(t *testing.T, key any) {
+			assert.Equal(t, elliptic.P384(), key.(*ecdsa.PrivateKey).Curve)
+		}},
+		{RSA2048, "RSA PRIVATE KEY", func(b []byte) (any, error) { return x509.ParsePKCS1PrivateKey(b) }, func(t *testing.T, key any) {
+			assert.Equal(t, 2048, key.(*rsa.PrivateKey).N.BitLen())
+		}},
+		{RSA3072, "RSA PRIVATE KEY", func(b []byte) (any, error) { return x509.ParsePKCS1PrivateKey(b) }, func(t *testing.T, key any) {
+			assert.Equal(t, 3072, key.(*rsa.PrivateKey).N.BitLen())
+		}},
+		{RSA4096, "RSA PRIVATE KEY", func(b []byte) (any, error) { return x509.ParsePKCS1PrivateKey(b) }, func(t *testing.T, key any) {
+			assert.Equal(t, 4096, key.(*rsa.PrivateKey).N.BitLen())
+		}},
+		{Ed25519, "PRIVATE KEY", x509.ParsePKCS8PrivateKey, func(t *testing.T, key any) {
+			assert.IsType(t, ed25519.PrivateKey{}, key)
+		}},
+	} {
+		privateKey, err := Generate(c.keyType)
+		require.NoError(t, err, c.keyType)
+
+		data, err := PEMEncode(privateKey)
+		require.NoError(t, err, c.keyType)
+
+		block, rest := pem.Decode(data)
+		require.NotNil(t, block, c.keyType)
+		assert.Empty(t, rest, c.keyType)
+		assert.Equal(t, c.blockType, block.Type, c.keyType)
+
+		parsed, err := c.parse(block.Bytes)
+		require.NoError(t, err, c.keyType)
+		c.check(t, parsed)
+		assert.True(t, parsed.(interface{ Equal(crypto.PrivateKey) bool }).Equal(privateKey), c.keyType)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	t.Parallel()
+
+	_, err := Generate("invalid")
+	assert.ErrorIs(t, err, ErrInvalidType)
+
+	privateKey, err := Generate(EC256)
+	require.NoError(t, err)
+	_, err = PEMEncode(opaqueSigner{Signer: privateKey})
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+}
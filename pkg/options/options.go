@@ -20,10 +20,12 @@ package options
 
 import (
 	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/keys"
 	"github.com/loopholelabs/certifier/pkg/storage"
 	"github.com/loopholelabs/logging"
 	"github.com/rs/zerolog"
 	"io/ioutil"
+	"time"
 )
 
 // Option is used to generate options internally
@@ -35,6 +37,9 @@ var DefaultLogger logging.Logger
 // DefaultStorage is the default Storage
 var DefaultStorage storage.Storage
 
+// DefaultCertificateStorage is the default CertificateStorage
+var DefaultCertificateStorage storage.CertificateStorage
+
 // DefaultTrustedNameServers is the default TrustedNameServers
 var DefaultTrustedNameServers = []string{
 	"8.8.8.8:53",
@@ -43,11 +48,36 @@ var DefaultTrustedNameServers = []string{
 	"1.0.0.1:53",
 }
 
+// DefaultKeyType is the default KeyType
+var DefaultKeyType = keys.EC256
+
+// DefaultRenewalFraction is the default RenewalFraction
+var DefaultRenewalFraction = 2.0 / 3.0
+
+// DefaultRenewalJitter is the default RenewalJitter
+var DefaultRenewalJitter = time.Hour
+
+// DefaultRenewalMinBackoff is the default RenewalMinBackoff
+var DefaultRenewalMinBackoff = time.Minute
+
+// DefaultRenewalMaxBackoff is the default RenewalMaxBackoff
+var DefaultRenewalMaxBackoff = time.Hour * 6
+
+// DefaultDNSChallengeTTL is the default DNSChallengeTTL
+var DefaultDNSChallengeTTL = time.Hour
+
+// DefaultDNSChallengeSweepInterval is the default DNSChallengeSweepInterval
+var DefaultDNSChallengeSweepInterval = time.Minute * 5
+
+// DefaultCIDGracePeriod is the default CIDGracePeriod
+var DefaultCIDGracePeriod = time.Hour * 24 * 7
+
 // init initializes the DefaultLogger and sets up the DefaultStorage
 func init() {
 	l := zerolog.New(ioutil.Discard)
 	DefaultLogger = logging.ConvertZerolog(&l)
 	DefaultStorage = memory.New()
+	DefaultCertificateStorage = memory.NewCertificates()
 }
 
 // Options is used to provide configuration options.
@@ -56,18 +86,77 @@ func init() {
 //	options := Options {
 //		Logger: DefaultLogger,
 //      Storage: DefaultStorage,
+//      CertificateStorage: DefaultCertificateStorage,
 //	    TrustedNameServers: DefaultTrustedNameServers,
+//	    KeyType: DefaultKeyType,
+//	    RenewalFraction: DefaultRenewalFraction,
+//	    RenewalJitter: DefaultRenewalJitter,
+//	    RenewalMinBackoff: DefaultRenewalMinBackoff,
+//	    RenewalMaxBackoff: DefaultRenewalMaxBackoff,
+//	    DNSChallengeTTL: DefaultDNSChallengeTTL,
+//	    DNSChallengeSweepInterval: DefaultDNSChallengeSweepInterval,
+//	    CIDGracePeriod: DefaultCIDGracePeriod,
+//	    RequireAllowedDomains: false,
+//	    SkipDelegationCheck: false,
+//	    LegacyLabels: false,
+//	    Root: "",
+//	    CookieSecret: nil,
 //	}
 type Options struct {
 	Logger             logging.Logger
 	Storage            storage.Storage
+	CertificateStorage storage.CertificateStorage
 	TrustedNameServers []string
+	KeyType            keys.Type
+
+	// RenewalFraction is the fraction of a certificate's lifetime after which it is renewed
+	RenewalFraction float64
+
+	// RenewalJitter is the maximum random duration by which a renewal is brought forward, where zero disables jitter
+	RenewalJitter time.Duration
+
+	// RenewalMinBackoff is the delay before retrying a renewal after the first failure,
+	// which doubles with each consecutive failure up to RenewalMaxBackoff
+	RenewalMinBackoff time.Duration
+	RenewalMaxBackoff time.Duration
+
+	// DNSChallengeTTL is how long a DNS challenge is kept in storage before it is considered stale and expired
+	DNSChallengeTTL time.Duration
+
+	// DNSChallengeSweepInterval is how often stale DNS challenges are expired
+	DNSChallengeSweepInterval time.Duration
+
+	// CIDGracePeriod is how long a CID remains valid after it has been rotated
+	CIDGracePeriod time.Duration
+
+	// RequireAllowedDomains refuses to obtain certificates (or answer DNS-01 Challenges) for IDs that have no
+	// allowed domains, rather than allowing any domain for them
+	RequireAllowedDomains bool
+
+	// SkipDelegationCheck skips checking the _acme-challenge CNAME records of domains using the
+	// TrustedNameServers before ordering certificates for them
+	SkipDelegationCheck bool
+
+	// LegacyLabels also presents DNS-01 Challenges under the ambiguous labels used by earlier versions of
+	// Certifier (see utils.NormalizeDomain), so that existing CNAME records for domains with hyphens keep working
+	LegacyLabels bool
+
+	// Root is the root domain of the dns.DNS instance that answers DNS-01 Challenges, which acme.ACME
+	// needs to build the _acme-challenge CNAME targets of domains
+	Root string
+
+	// CookieSecret is the secret that the DNS server uses to generate and verify DNS Cookies (RFC 7873). If it is empty,
+	// a random secret is generated for every dns.DNS instance, so instances that share an address must be given the same secret
+	CookieSecret []byte
 }
 
 // LoadOptions takes a variadic number of Option variables and returns a *Options struct that contains default
 // sanitized values.
 func LoadOptions(options ...Option) *Options {
-	opts := new(Options)
+	opts := &Options{
+		// a RenewalJitter of zero disables jitter, so the default must be set before the options are applied
+		RenewalJitter: DefaultRenewalJitter,
+	}
 	for _, option := range options {
 		option(opts)
 	}
@@ -80,10 +169,50 @@ func LoadOptions(options ...Option) *Options {
 		opts.Storage = DefaultStorage
 	}
 
+	if opts.CertificateStorage == nil {
+		opts.CertificateStorage = DefaultCertificateStorage
+	}
+
 	if opts.TrustedNameServers == nil {
 		opts.TrustedNameServers = DefaultTrustedNameServers
 	}
 
+	if opts.KeyType == "" {
+		opts.KeyType = DefaultKeyType
+	}
+
+	if opts.RenewalFraction <= 0 || opts.RenewalFraction >= 1 {
+		opts.RenewalFraction = DefaultRenewalFraction
+	}
+
+	if opts.RenewalJitter < 0 {
+		opts.RenewalJitter = DefaultRenewalJitter
+	}
+
+	if opts.RenewalMinBackoff <= 0 {
+		opts.RenewalMinBackoff = DefaultRenewalMinBackoff
+	}
+
+	if opts.RenewalMaxBackoff <= 0 {
+		opts.RenewalMaxBackoff = DefaultRenewalMaxBackoff
+	}
+
+	if opts.RenewalMaxBackoff < opts.RenewalMinBackoff {
+		opts.RenewalMaxBackoff = opts.RenewalMinBackoff
+	}
+
+	if opts.DNSChallengeTTL <= 0 {
+		opts.DNSChallengeTTL = DefaultDNSChallengeTTL
+	}
+
+	if opts.DNSChallengeSweepInterval <= 0 {
+		opts.DNSChallengeSweepInterval = DefaultDNSChallengeSweepInterval
+	}
+
+	if opts.CIDGracePeriod <= 0 {
+		opts.CIDGracePeriod = DefaultCIDGracePeriod
+	}
+
 	return opts
 }
 
@@ -108,9 +237,102 @@ func WithStorage(storage storage.Storage) Option {
 	}
 }
 
+// WithCertificateStorage sets the certificate storage
+func WithCertificateStorage(certificateStorage storage.CertificateStorage) Option {
+	return func(opts *Options) {
+		opts.CertificateStorage = certificateStorage
+	}
+}
+
 // WithTrustedNameservers sets the TrustedNameservers
 func WithTrustedNameservers(trustedNameservers []string) Option {
 	return func(opts *Options) {
 		opts.TrustedNameServers = trustedNameservers
 	}
 }
+
+// WithKeyType sets the KeyType used to generate certificate private keys
+func WithKeyType(keyType keys.Type) Option {
+	return func(opts *Options) {
+		opts.KeyType = keyType
+	}
+}
+
+// WithRenewalFraction sets the fraction of a certificate's lifetime after which it is renewed
+func WithRenewalFraction(renewalFraction float64) Option {
+	return func(opts *Options) {
+		opts.RenewalFraction = renewalFraction
+	}
+}
+
+// WithRenewalJitter sets the maximum random duration by which a renewal is brought forward,
+// where zero disables jitter and negative durations are replaced with DefaultRenewalJitter
+func WithRenewalJitter(renewalJitter time.Duration) Option {
+	return func(opts *Options) {
+		opts.RenewalJitter = renewalJitter
+	}
+}
+
+// WithRenewalBackoff sets the minimum and maximum delays before retrying a failed renewal
+func WithRenewalBackoff(minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(opts *Options) {
+		opts.RenewalMinBackoff = minBackoff
+		opts.RenewalMaxBackoff = maxBackoff
+	}
+}
+
+// WithDNSChallengeTTL sets how long a DNS challenge is kept in storage before it is expired
+func WithDNSChallengeTTL(ttl time.Duration) Option {
+	return func(opts *Options) {
+		opts.DNSChallengeTTL = ttl
+	}
+}
+
+// WithDNSChallengeSweepInterval sets how often stale DNS challenges are expired
+func WithDNSChallengeSweepInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.DNSChallengeSweepInterval = interval
+	}
+}
+
+// WithCIDGracePeriod sets how long a CID remains valid after it has been rotated
+func WithCIDGracePeriod(gracePeriod time.Duration) Option {
+	return func(opts *Options) {
+		opts.CIDGracePeriod = gracePeriod
+	}
+}
+
+// WithRequireAllowedDomains sets whether IDs must have allowed domains before certificates can be obtained for them
+func WithRequireAllowedDomains(requireAllowedDomains bool) Option {
+	return func(opts *Options) {
+		opts.RequireAllowedDomains = requireAllowedDomains
+	}
+}
+
+// WithSkipDelegationCheck sets whether the _acme-challenge CNAME records of domains are checked before ordering certificates
+func WithSkipDelegationCheck(skipDelegationCheck bool) Option {
+	return func(opts *Options) {
+		opts.SkipDelegationCheck = skipDelegationCheck
+	}
+}
+
+// WithLegacyLabels sets whether DNS-01 Challenges are also presented under the labels used by earlier versions of Certifier
+func WithLegacyLabels(legacyLabels bool) Option {
+	return func(opts *Options) {
+		opts.LegacyLabels = legacyLabels
+	}
+}
+
+// WithRoot sets the root domain of the dns.DNS instance that answers DNS-01 Challenges
+func WithRoot(root string) Option {
+	return func(opts *Options) {
+		opts.Root = root
+	}
+}
+
+// WithCookieSecret sets the secret that is used to generate and verify DNS Cookies
+func WithCookieSecret(cookieSecret []byte) Option {
+	return func(opts *Options) {
+		opts.CookieSecret = cookieSecret
+	}
+}
@@ -17,55 +17,164 @@
 package provider
 
 import (
+	"context"
+	"errors"
 	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/loopholelabs/certifier/pkg/options"
 	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
 	"github.com/loopholelabs/logging"
+	"strings"
+	"sync"
 )
 
 var _ challenge.Provider = (*Provider)(nil)
 
 // Provider satisfies the challenge.Provider interface for renewing
 // ACME Certificates using the DNS-01 Challenge
+//
+// A single Provider can present challenges for every domain in a certificate
+// request, as each challenge is stored under the labels (see utils.ChallengeLabels) of the domain it was presented for
 type Provider struct {
 	// options contains the options used to configure this instance of Provider
 	options *options.Options
 
+	// ctx is the context that challenges are presented with
+	ctx context.Context
+
 	// cid is the CID for this Provider
 	cid string
 
-	// domain is the domain for this instance of Provider
-	domain string
+	// presented contains the challengeKeys that have been presented and not yet
+	// cleaned up, keyed by the label they were presented under
+	presented   map[string][]string
+	presentedMu sync.Mutex
+}
+
+// New creates a new instance of Provider for the given CID
+//
+// Deprecated: the domain is ignored, since challenges are stored under the labels of the domain they are
+// presented for, so a single Provider can be used for every domain in a certificate request. Use NewWithContext instead.
+func New(cid string, _ string, options *options.Options) *Provider {
+	return NewWithContext(context.Background(), cid, options)
 }
 
-func New(cid string, domain string, options *options.Options) *Provider {
+// NewWithContext creates a new instance of Provider that stops presenting
+// challenges once the given context is done
+func NewWithContext(ctx context.Context, cid string, options *options.Options) *Provider {
 	return &Provider{
-		cid:     cid,
-		domain:  domain,
-		options: options,
+		ctx:       ctx,
+		cid:       cid,
+		options:   options,
+		presented: make(map[string][]string),
 	}
 }
 
 // Present fulfills the challenge.Provider.Present interface function
+//
+// The challengeKey is set under every label of the domain, and if setting it under
+// one of the labels fails, it is removed from the labels it was already set under.
+// The domain of a hashed label is recorded first, so that dns.DNS can check it against the allowed domains.
 func (p *Provider) Present(domain, _, keyAuth string) error {
 	_, challengeKey := dns01.GetRecord(domain, keyAuth)
-	err := p.storage().SetDNSChallenge(p.cid, p.domain, challengeKey)
-	if err != nil {
-		return err
+	labels := p.labels(domain)
+	if utils.IsHashedLabel(labels[0]) {
+		err := storage.SetHashedLabelContext(p.ctx, p.storage(), labels[0], strings.ToLower(strings.TrimSuffix(utils.TrimWildcard(domain), ".")))
+		if err != nil {
+			return err
+		}
+	}
+	for i, label := range labels {
+		err := storage.SetDNSChallengeContext(p.ctx, p.storage(), p.cid, label, challengeKey)
+		if err != nil {
+			for _, set := range labels[:i] {
+				p.forget(set, challengeKey)
+				_ = storage.RemoveDNSChallengeContext(context.WithoutCancel(p.ctx), p.storage(), p.cid, set, challengeKey)
+			}
+			return err
+		}
+		p.presentedMu.Lock()
+		p.presented[label] = append(p.presented[label], challengeKey)
+		p.presentedMu.Unlock()
+		p.logger().Debugf("setting challengeKey '%s' for CID '%s' and label '%s'\n", challengeKey, p.cid, label)
 	}
-	p.logger().Debugf("setting challengeKey '%s' for CID '%s' and domain '%s'\n", challengeKey, p.cid, p.domain)
 	return nil
 }
 
 // CleanUp fulfills the challenge.Provider.CleanUp interface function
-func (p *Provider) CleanUp(_, _, _ string) error {
-	err := p.storage().RemoveDNSChallenge(p.cid, p.domain)
-	if err != nil {
-		return err
+//
+// Only the challengeKey derived from keyAuth is removed, so other challenges
+// that are still being presented for the same CID and domain are left in place.
+// Challenges are cleaned up even if the context of the Provider is done.
+func (p *Provider) CleanUp(domain, _, keyAuth string) error {
+	_, challengeKey := dns01.GetRecord(domain, keyAuth)
+	var errs []error
+	for _, label := range p.labels(domain) {
+		p.forget(label, challengeKey)
+		err := storage.RemoveDNSChallengeContext(context.WithoutCancel(p.ctx), p.storage(), p.cid, label, challengeKey)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.logger().Debugf("removing challengeKey '%s' for CID '%s' and label '%s'\n", challengeKey, p.cid, label)
 	}
-	p.logger().Debugf("removing challengeKey for CID '%s' and domain '%s'\n", p.cid, p.domain)
-	return nil
+	return errors.Join(errs...)
+}
+
+// CleanUpAll removes every challenge that has been presented by this
+// Provider and not yet cleaned up, even if the context of the Provider is done
+func (p *Provider) CleanUpAll() error {
+	p.presentedMu.Lock()
+	presented := p.presented
+	p.presented = make(map[string][]string)
+	p.presentedMu.Unlock()
+
+	var errs []error
+	ctx := context.WithoutCancel(p.ctx)
+	for label, challengeKeys := range presented {
+		for _, challengeKey := range challengeKeys {
+			err := storage.RemoveDNSChallengeContext(ctx, p.storage(), p.cid, label, challengeKey)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				errs = append(errs, err)
+				continue
+			}
+			p.logger().Debugf("removing challengeKey '%s' for CID '%s' and label '%s'\n", challengeKey, p.cid, label)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PreCheck satisfies the dns01.WrapPreCheckFunc type, and stops
+// propagation checks from running once the context of the Provider is done
+func (p *Provider) PreCheck(_, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+	if err := p.ctx.Err(); err != nil {
+		return false, err
+	}
+	return check(fqdn, value)
+}
+
+// forget removes a challengeKey from the set of presented challenges
+func (p *Provider) forget(label string, challengeKey string) {
+	p.presentedMu.Lock()
+	challengeKeys := p.presented[label]
+	for i, c := range challengeKeys {
+		if c == challengeKey {
+			challengeKeys = append(challengeKeys[:i:i], challengeKeys[i+1:]...)
+			break
+		}
+	}
+	if len(challengeKeys) == 0 {
+		delete(p.presented, label)
+	} else {
+		p.presented[label] = challengeKeys
+	}
+	p.presentedMu.Unlock()
+}
+
+// labels returns the labels that the challenges for a domain are presented under
+func (p *Provider) labels(domain string) []string {
+	return utils.ChallengeLabels(domain, p.options.LegacyLabels)
 }
 
 // storage returns the storage interface for this instance of Provider
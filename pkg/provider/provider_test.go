@@ -0,0 +1,75 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestProvider(t *testing.T) {
+	t.Parallel()
+
+	s := memory.New()
+	p := NewWithContext(context.Background(), "cid", options.LoadOptions(options.WithStorage(s)))
+
+	_, base := dns01.GetRecord("example.com", "base")
+	_, wildcard := dns01.GetRecord("*.example.com", "wildcard")
+
+	// a wildcard domain is validated using the challenge record of its base domain
+	require.NoError(t, p.Present("example.com", "", "base"))
+	require.NoError(t, p.Present("*.example.com", "", "wildcard"))
+
+	challenges, ok := s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{base, wildcard}, challenges)
+
+	require.NoError(t, p.CleanUp("*.example.com", "", "wildcard"))
+	challenges, ok = s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{base}, challenges, "CleanUp must only remove its own challenge")
+
+	require.NoError(t, p.CleanUpAll())
+	_, ok = s.GetDNSChallenges("cid", "example-com")
+	assert.False(t, ok)
+}
+
+func TestProviderHashedLabel(t *testing.T) {
+	t.Parallel()
+
+	s := memory.New()
+	p := NewWithContext(context.Background(), "cid", options.LoadOptions(options.WithStorage(s)))
+
+	// the domain of a hashed label is recorded so that the DNS server can check it against the allowed domains
+	domain := strings.Repeat("a", 63) + ".example.com"
+	label := utils.HashedLabel(domain)
+	require.NoError(t, p.Present("*."+strings.ToUpper(domain)+".", "", "keyAuth"))
+
+	recorded, ok := s.GetHashedLabel(label)
+	require.True(t, ok)
+	assert.Equal(t, domain, recorded)
+
+	_, ok = s.GetDNSChallenges("cid", label)
+	assert.True(t, ok)
+}
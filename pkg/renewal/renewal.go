@@ -0,0 +1,354 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package renewal automatically renews certificates obtained
+// using an acme.ACME instance before they expire
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/loopholelabs/certifier/pkg/acme"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/logging"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// EventsBufferSize is the number of events that are buffered before new events are dropped
+	EventsBufferSize = 64
+)
+
+var (
+	// ErrAlreadyManaged is returned when a certificate is already being managed for an ID and domain
+	ErrAlreadyManaged = errors.New("already managed")
+
+	// ErrNotManaged is returned when no certificate is being managed for an ID and domain
+	ErrNotManaged = errors.New("not managed")
+
+	// ErrStopped is returned when a certificate is added to a Manager that has been stopped
+	ErrStopped = errors.New("manager stopped")
+)
+
+// Event is emitted by a Manager every time it attempts to renew a certificate
+type Event struct {
+	// ID is the ID that the certificate was obtained for
+	ID string
+
+	// Domain is the primary domain of the certificate
+	Domain string
+
+	// Resource is the renewed certificate, and is nil if the renewal failed
+	Resource *certificate.Resource
+
+	// Err is the reason the renewal failed, and is nil if the renewal succeeded
+	Err error
+
+	// Failures is the number of consecutive failed renewals
+	Failures int
+
+	// Next is the time of the next renewal attempt
+	Next time.Time
+}
+
+// Renewer obtains certificates for a Manager, and is implemented by *acme.ACME
+type Renewer interface {
+	RenewDNSDomainsContext(ctx context.Context, id string, domains []string, client *lego.Client, privateKey crypto.Signer) (*certificate.Resource, error)
+}
+
+var _ Renewer = (*acme.ACME)(nil)
+
+// key identifies a managed certificate
+type key struct {
+	id     string
+	domain string
+}
+
+// entry is a certificate being managed by a Manager
+type entry struct {
+	id         string
+	domains    []string
+	client     *lego.Client
+	privateKey crypto.Signer
+	resource   *certificate.Resource
+	lock       *clientLock
+	done       chan struct{}
+}
+
+// clientLock serializes the renewals that share a lego.Client, and counts the entries using the lego.Client
+type clientLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Manager tracks certificates by ID and domain, and renews them
+// after a configurable fraction of their lifetime has passed
+type Manager struct {
+	// options contains the options used to configure this instance of Manager
+	options *options.Options
+
+	// renewer is the Renewer (usually an acme.ACME instance) used to renew certificates
+	renewer Renewer
+
+	entries   map[key]*entry
+	entriesMu sync.Mutex
+
+	// clients serializes renewals that share a lego.Client, since the DNS-01 provider is configured
+	// on the client itself, and only contains the lego.Clients of entries that are still running
+	clients   map[*lego.Client]*clientLock
+	clientsMu sync.Mutex
+
+	// ctx is canceled when the Manager is stopped, which also cancels in-progress renewals
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	events   chan Event
+	stopped  chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a new instance of Manager that renews certificates using the given
+// Renewer (usually an acme.ACME instance) and set of configuration options
+func New(renewer Renewer, opts ...options.Option) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		ctx:     ctx,
+		cancel:  cancel,
+		options: options.LoadOptions(opts...),
+		renewer: renewer,
+		entries: make(map[key]*entry),
+		clients: make(map[*lego.Client]*clientLock),
+		events:  make(chan Event, EventsBufferSize),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Manage starts renewing the certificate for a given ID and set of domains
+//
+// If resource is nil, a certificate is obtained immediately, otherwise the certificate is renewed once
+// the configured fraction of its lifetime has passed. The privateKey is reused for every renewal, and if it is nil
+// a new private key is generated for every renewal.
+func (m *Manager) Manage(id string, domains []string, client *lego.Client, privateKey crypto.Signer, resource *certificate.Resource) error {
+	if len(domains) == 0 {
+		return acme.NoDomainsError
+	}
+
+	k := key{id: id, domain: domains[0]}
+	e := &entry{
+		id:         id,
+		domains:    domains,
+		client:     client,
+		privateKey: privateKey,
+		resource:   resource,
+		done:       make(chan struct{}),
+	}
+
+	m.entriesMu.Lock()
+	select {
+	case <-m.stopped:
+		m.entriesMu.Unlock()
+		return ErrStopped
+	default:
+	}
+	if _, ok := m.entries[k]; ok {
+		m.entriesMu.Unlock()
+		return ErrAlreadyManaged
+	}
+	m.entries[k] = e
+	m.wg.Add(1)
+	m.entriesMu.Unlock()
+
+	e.lock = m.acquireClient(client)
+
+	m.logger().Debugf("managing certificate for id '%s' and domains %q\n", id, domains)
+	go m.run(e)
+	return nil
+}
+
+// Unmanage stops renewing the certificate for a given ID and primary domain
+func (m *Manager) Unmanage(id string, domain string) error {
+	m.entriesMu.Lock()
+	k := key{id: id, domain: domain}
+	e, ok := m.entries[k]
+	if !ok {
+		m.entriesMu.Unlock()
+		return ErrNotManaged
+	}
+	delete(m.entries, k)
+	m.entriesMu.Unlock()
+
+	close(e.done)
+	m.logger().Debugf("stopped managing certificate for id '%s' and domain '%s'\n", id, domain)
+	return nil
+}
+
+// Events returns the channel that renewal events are emitted on
+//
+// Events are dropped if the channel is full, and the channel is closed once the Manager is stopped
+func (m *Manager) Events() <-chan Event {
+	return m.events
+}
+
+// Stop stops renewing all the managed certificates, canceling any in-progress
+// renewals and waiting for them to return
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		m.logger().Infof("stopping renewal manager\n")
+		m.entriesMu.Lock()
+		close(m.stopped)
+		m.cancel()
+		m.entries = make(map[key]*entry)
+		m.entriesMu.Unlock()
+		m.wg.Wait()
+		close(m.events)
+	})
+}
+
+// run renews the certificate for the given entry until the entry
+// is no longer managed or the Manager is stopped
+func (m *Manager) run(e *entry) {
+	defer m.wg.Done()
+	defer m.releaseClient(e.client)
+
+	next := time.Now()
+	if e.resource != nil {
+		var err error
+		next, err = m.renewalTime(e.resource)
+		if err != nil {
+			m.logger().Warnf("unable to parse certificate for id '%s' and domains %q, renewing immediately: %s\n", e.id, e.domains, err)
+			next = time.Now()
+		}
+	}
+
+	failures := 0
+	for {
+		m.logger().Debugf("next renewal for id '%s' and domains %q is at %s\n", e.id, e.domains, next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-e.done:
+			timer.Stop()
+			return
+		case <-m.stopped:
+			timer.Stop()
+			return
+		}
+
+		resource, err := m.renew(e)
+		if errors.Is(err, acme.CanceledError) && m.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			next, err = m.renewalTime(resource)
+		}
+		if err != nil {
+			failures++
+			next = time.Now().Add(m.backoff(failures))
+			m.logger().Errorf("unable to renew certificate for id '%s' and domains %q (%d consecutive failures): %s\n", e.id, e.domains, failures, err)
+			m.emit(Event{ID: e.id, Domain: e.domains[0], Err: err, Failures: failures, Next: next})
+			continue
+		}
+
+		failures = 0
+		e.resource = resource
+		m.logger().Infof("renewed certificate for id '%s' and domains %q\n", e.id, e.domains)
+		m.emit(Event{ID: e.id, Domain: e.domains[0], Resource: resource, Next: next})
+	}
+}
+
+// renew renews the certificate for the given entry, making sure that
+// no other renewal is using the same lego.Client at the same time
+func (m *Manager) renew(e *entry) (*certificate.Resource, error) {
+	e.lock.mu.Lock()
+	defer e.lock.mu.Unlock()
+	resource, err := m.renewer.RenewDNSDomainsContext(m.ctx, e.id, e.domains, e.client, e.privateKey)
+	if resource != nil && err != nil {
+		// the certificate was renewed but could not be stored, which should not cause it to be renewed again
+		m.logger().Warnf("renewed certificate for id '%s' and domains %q could not be stored: %s\n", e.id, e.domains, err)
+		err = nil
+	}
+	return resource, err
+}
+
+// acquireClient returns the clientLock for the given lego.Client, creating it if no other entry is using the lego.Client
+func (m *Manager) acquireClient(client *lego.Client) *clientLock {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+	lock, ok := m.clients[client]
+	if !ok {
+		lock = new(clientLock)
+		m.clients[client] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+// releaseClient releases the clientLock for the given lego.Client once an entry stops running,
+// removing it once no other entry is using the lego.Client
+func (m *Manager) releaseClient(client *lego.Client) {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+	lock := m.clients[client]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(m.clients, client)
+	}
+}
+
+// renewalTime returns the time at which the given certificate should be renewed
+func (m *Manager) renewalTime(resource *certificate.Resource) (time.Time, error) {
+	cert, err := certcrypto.ParsePEMCertificate(resource.Certificate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	renewal := cert.NotBefore.Add(time.Duration(float64(lifetime) * m.options.RenewalFraction))
+	return renewal.Add(-time.Duration(rand.Int63n(int64(m.options.RenewalJitter) + 1))), nil
+}
+
+// backoff returns the delay before retrying a renewal after
+// the given number of consecutive failures
+func (m *Manager) backoff(failures int) time.Duration {
+	backoff := m.options.RenewalMinBackoff
+	for i := 1; i < failures && backoff < m.options.RenewalMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > m.options.RenewalMaxBackoff {
+		backoff = m.options.RenewalMaxBackoff
+	}
+	return backoff
+}
+
+// emit emits an Event without blocking, dropping it if the events channel is full
+func (m *Manager) emit(event Event) {
+	select {
+	case m.events <- event:
+	default:
+		m.logger().Warnf("dropping renewal event for id '%s' and domain '%s', events channel is full\n", event.ID, event.Domain)
+	}
+}
+
+// logger returns the logging interface for this instance of Manager
+func (m *Manager) logger() logging.Logger {
+	return m.options.Logger
+}
@@ -0,0 +1,210 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package renewal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/loopholelabs/certifier/pkg/acme"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// renewer is a Renewer that returns the next result from results for every renewal
+type renewer struct {
+	mu      sync.Mutex
+	results []result
+	calls   []time.Time
+}
+
+type result struct {
+	resource *certificate.Resource
+	err      error
+}
+
+func (r *renewer) RenewDNSDomainsContext(_ context.Context, _ string, _ []string, _ *lego.Client, _ crypto.Signer) (*certificate.Resource, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, time.Now())
+	if len(r.results) == 0 {
+		return nil, errors.New("no results")
+	}
+	res := r.results[0]
+	r.results = r.results[1:]
+	return res.resource, res.err
+}
+
+func testCertificate(t *testing.T, notBefore time.Time, notAfter time.Time) *certificate.Resource {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	return &certificate.Resource{Domain: "example.com", Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	m := New(acme.New(), options.WithRenewalBackoff(time.Minute, time.Minute*10))
+	assert.Equal(t, time.Minute, m.backoff(1))
+	assert.Equal(t, time.Minute*2, m.backoff(2))
+	assert.Equal(t, time.Minute*8, m.backoff(4))
+	assert.Equal(t, time.Minute*10, m.backoff(5))
+	assert.Equal(t, time.Minute*10, m.backoff(100))
+}
+
+func TestRenewalTime(t *testing.T) {
+	t.Parallel()
+
+	notBefore := time.Now().Truncate(time.Second)
+	resource := testCertificate(t, notBefore, notBefore.Add(time.Hour*24*90))
+
+	const jitter = time.Hour
+	m := New(acme.New(), options.WithRenewalFraction(2.0/3.0), options.WithRenewalJitter(jitter))
+	renewal, err := m.renewalTime(resource)
+	require.NoError(t, err)
+
+	expected := notBefore.Add(time.Hour * 24 * 60)
+	assert.False(t, renewal.After(expected))
+	assert.False(t, renewal.Before(expected.Add(-jitter)))
+
+	m = New(acme.New(), options.WithRenewalFraction(2.0/3.0), options.WithRenewalJitter(0))
+	renewal, err = m.renewalTime(resource)
+	require.NoError(t, err)
+	assert.True(t, renewal.Equal(expected))
+
+	_, err = m.renewalTime(&certificate.Resource{Certificate: []byte("invalid")})
+	assert.Error(t, err)
+}
+
+func TestManage(t *testing.T) {
+	t.Parallel()
+
+	m := New(acme.New())
+	assert.ErrorIs(t, m.Manage("id", nil, nil, nil, nil), acme.NoDomainsError)
+	assert.ErrorIs(t, m.Unmanage("id", "example.com"), ErrNotManaged)
+
+	m.Stop()
+	assert.ErrorIs(t, m.Manage("id", []string{"example.com"}, nil, nil, nil), ErrStopped)
+
+	_, ok := <-m.Events()
+	assert.False(t, ok)
+}
+
+func TestRenew(t *testing.T) {
+	t.Parallel()
+
+	const minBackoff = time.Millisecond * 100
+	renewed := testCertificate(t, time.Now().Truncate(time.Second), time.Now().Add(time.Hour*24*90))
+	r := &renewer{results: []result{{err: errors.New("renewal failed")}, {resource: renewed}}}
+	m := New(r, options.WithRenewalFraction(0.5), options.WithRenewalJitter(0), options.WithRenewalBackoff(minBackoff, time.Second))
+	t.Cleanup(m.Stop)
+
+	// the certificate is renewed once half of its lifetime has passed, which is 2 seconds from now
+	notBefore := time.Now().Truncate(time.Second).Add(-time.Second * 8)
+	expected := notBefore.Add(time.Second * 10)
+	client := new(lego.Client)
+	require.NoError(t, m.Manage("id", []string{"example.com"}, client, nil, testCertificate(t, notBefore, notBefore.Add(time.Second*20))))
+	assert.ErrorIs(t, m.Manage("id", []string{"example.com"}, client, nil, nil), ErrAlreadyManaged)
+
+	var event Event
+	select {
+	case event = <-m.Events():
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting for failed renewal")
+	}
+	assert.Equal(t, "id", event.ID)
+	assert.Equal(t, "example.com", event.Domain)
+	assert.Nil(t, event.Resource)
+	assert.EqualError(t, event.Err, "renewal failed")
+	assert.Equal(t, 1, event.Failures)
+	assert.WithinDuration(t, time.Now().Add(minBackoff), event.Next, minBackoff)
+
+	select {
+	case event = <-m.Events():
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting for successful renewal")
+	}
+	assert.Equal(t, "id", event.ID)
+	assert.Equal(t, renewed, event.Resource)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, 0, event.Failures)
+	assert.True(t, event.Next.After(time.Now().Add(time.Hour*24*44)))
+
+	r.mu.Lock()
+	require.Len(t, r.calls, 2)
+	assert.False(t, r.calls[0].Before(expected.Add(-time.Millisecond)))
+	assert.False(t, r.calls[1].Before(r.calls[0].Add(minBackoff)))
+	r.mu.Unlock()
+
+	require.NoError(t, m.Unmanage("id", "example.com"))
+	assert.Eventually(t, func() bool {
+		m.clientsMu.Lock()
+		defer m.clientsMu.Unlock()
+		return len(m.clients) == 0
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestSharedClient(t *testing.T) {
+	t.Parallel()
+
+	notBefore := time.Now().Truncate(time.Second)
+	resource := testCertificate(t, notBefore, notBefore.Add(time.Hour*24*90))
+	m := New(&renewer{})
+	t.Cleanup(m.Stop)
+
+	client := new(lego.Client)
+	require.NoError(t, m.Manage("id", []string{"example.com"}, client, nil, resource))
+	require.NoError(t, m.Manage("id", []string{"example.org"}, client, nil, resource))
+
+	m.clientsMu.Lock()
+	assert.Len(t, m.clients, 1)
+	assert.Equal(t, 2, m.clients[client].refs)
+	m.clientsMu.Unlock()
+
+	require.NoError(t, m.Unmanage("id", "example.com"))
+	assert.Eventually(t, func() bool {
+		m.clientsMu.Lock()
+		defer m.clientsMu.Unlock()
+		return m.clients[client] != nil && m.clients[client].refs == 1
+	}, time.Second, time.Millisecond*10)
+
+	m.Stop()
+	m.clientsMu.Lock()
+	assert.Empty(t, m.clients)
+	m.clientsMu.Unlock()
+}
@@ -0,0 +1,552 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package bolt is a storage.Storage implementation backed by an embedded bbolt key-value database
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"go.etcd.io/bbolt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// SchemaVersion is the version of the database schema written by Bolt
+	SchemaVersion = 7
+
+	// OpenTimeout is how long New waits to obtain the lock on the database file
+	OpenTimeout = time.Second
+)
+
+var (
+	// MetaBucket contains metadata about the database, such as the schema version
+	MetaBucket = []byte("meta")
+
+	// CIDsBucket maps IDs to CIDs
+	CIDsBucket = []byte("cids")
+
+	// IDsBucket indexes the IDs that each CID is registered for, with keys made up
+	// of the CID and the ID separated by a zero byte, and empty values
+	IDsBucket = []byte("ids")
+
+	// RetiredCIDsBucket maps retired CIDs to the ID they were registered for and the end of their grace period
+	RetiredCIDsBucket = []byte("retired_cids")
+
+	// AllowedDomainsBucket maps IDs to the domain patterns that certificates may be obtained for
+	AllowedDomainsBucket = []byte("allowed_domains")
+
+	// HashedLabelsBucket maps hashed labels to the domains they were generated for
+	HashedLabelsBucket = []byte("hashed_labels")
+
+	// DNSChallengesBucket maps CIDs and encoded domain labels to DNS challenges, with keys made up
+	// of the CID and the label separated by a null byte so that they are ordered like storage.DNSChallenge
+	DNSChallengesBucket = []byte("dns_challenges")
+
+	// CertificatesBucket is reserved for storing certificates
+	CertificatesBucket = []byte("certificates")
+
+	// versionKey is the key of the schema version in the MetaBucket
+	versionKey = []byte("version")
+)
+
+var (
+	// ErrUnsupportedVersion is returned when the database was written by a newer version of Bolt
+	ErrUnsupportedVersion = errors.New("unsupported database schema version")
+)
+
+// migrations upgrade the database schema, where migrations[i] upgrades the schema from version i+1 to version i+2
+var migrations = []func(tx *bbolt.Tx) error{
+	// version 2 records when each DNS challenge was set, and since version 1 did not,
+	// existing challenges are treated as having been set when the database was upgraded
+	func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(DNSChallengesBucket)
+		now := time.Now()
+		upgraded := make(map[string][]dnsChallenge)
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			var challenges []string
+			if err := json.Unmarshal(value, &challenges); err != nil {
+				return err
+			}
+			for _, c := range challenges {
+				upgraded[string(key)] = append(upgraded[string(key)], dnsChallenge{Challenge: c, CreatedAt: now})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, challenges := range upgraded {
+			if err = putChallenges(bucket, []byte(key), challenges); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// version 3 indexes the IDs that each CID is registered for
+	func(tx *bbolt.Tx) error {
+		ids := tx.Bucket(IDsBucket)
+		return tx.Bucket(CIDsBucket).ForEach(func(id []byte, cid []byte) error {
+			return ids.Put(idIndexKey(string(cid), string(id)), []byte{})
+		})
+	},
+	// version 4 adds the RetiredCIDsBucket, which is created by initialize, so there
+	// is nothing to migrate, but earlier versions must not be able to open the database
+	func(tx *bbolt.Tx) error {
+		return nil
+	},
+	// version 5 adds the AllowedDomainsBucket, which is also created by initialize
+	func(tx *bbolt.Tx) error {
+		return nil
+	},
+	// version 6 adds the HashedLabelsBucket, which is also created by initialize
+	func(tx *bbolt.Tx) error {
+		return nil
+	},
+	// version 7 keys DNS challenges by CID and then label, rather than by label and then CID,
+	// so that they can be listed in order using a cursor
+	func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(DNSChallengesBucket)
+		rekeyed := make(map[string][]byte)
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			rekeyed[string(key)] = bytes.Clone(value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, value := range rekeyed {
+			if err = bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+			label, cid, _ := strings.Cut(key, ".")
+			if err = bucket.Put(challengeKey(cid, label), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// retiredCID is the ID that a retired CID was registered for, along with the end of its grace period
+type retiredCID struct {
+	ID    string    `json:"id"`
+	Until time.Time `json:"until"`
+}
+
+// dnsChallenge is a DNS challenge along with the time it was set
+type dnsChallenge struct {
+	Challenge string    `json:"challenge"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var _ storage.Storage = (*Bolt)(nil)
+
+// Bolt is a storage.Storage implementation that stores CIDs and DNS challenges in separate buckets
+// of a bbolt database, so that each change only rewrites the affected keys
+//
+// The database file is locked by bbolt for as long as the Bolt instance is open
+type Bolt struct {
+	db *bbolt.DB
+}
+
+// New opens (or creates) the bbolt database at the given path,
+// creating any missing buckets and upgrading the schema if necessary
+func New(path string) (*Bolt, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(initialize)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &Bolt{
+		db: db,
+	}, nil
+}
+
+// Close closes the database, releasing its lock
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *Bolt) SetCID(id string, cid string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(CIDsBucket)
+		if bucket.Get([]byte(id)) != nil {
+			return storage.ErrAlreadyExists
+		}
+		if err := bucket.Put([]byte(id), []byte(cid)); err != nil {
+			return err
+		}
+		return tx.Bucket(IDsBucket).Put(idIndexKey(cid, id), []byte{})
+	})
+}
+
+func (b *Bolt) GetCID(id string) (cid string, ok bool) {
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket(CIDsBucket).Get([]byte(id)); value != nil {
+			cid, ok = string(value), true
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) RemoveCID(id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(CIDsBucket)
+		cid := bucket.Get([]byte(id))
+		if cid == nil {
+			return storage.ErrNotFound
+		}
+		if err := tx.Bucket(IDsBucket).Delete(idIndexKey(string(cid), id)); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (b *Bolt) GetID(cid string) (id string, ok bool) {
+	prefix := idIndexKey(cid, "")
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		// index keys are sorted, so the first key with the CID as its prefix contains the lowest ID
+		key, _ := tx.Bucket(IDsBucket).Cursor().Seek(prefix)
+		if key != nil && strings.HasPrefix(string(key), string(prefix)) {
+			id, ok = string(key[len(prefix):]), true
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) ListCIDs(after string, limit int) (registrations []storage.Registration, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(CIDsBucket).Cursor()
+		for id, cid := c.Seek([]byte(after)); id != nil && (limit <= 0 || len(registrations) < limit); id, cid = c.Next() {
+			if string(id) == after {
+				continue
+			}
+			registrations = append(registrations, storage.Registration{ID: string(id), CID: string(cid)})
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) RetireCID(cid string, id string, until time.Time) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(RetiredCIDsBucket)
+		if bucket.Get([]byte(cid)) != nil {
+			return storage.ErrAlreadyExists
+		}
+		value, err := json.Marshal(retiredCID{ID: id, Until: until})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(cid), value)
+	})
+}
+
+func (b *Bolt) GetRetiredCID(cid string) (retired storage.RetiredCID, ok bool) {
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket(RetiredCIDsBucket).Get([]byte(cid)); value != nil {
+			var err error
+			retired, err = decodeRetiredCID([]byte(cid), value)
+			ok = err == nil
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) RemoveRetiredCID(cid string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(RetiredCIDsBucket)
+		if bucket.Get([]byte(cid)) == nil {
+			return storage.ErrNotFound
+		}
+		return bucket.Delete([]byte(cid))
+	})
+}
+
+func (b *Bolt) ListRetiredCIDs(after string, limit int) (retired []storage.RetiredCID, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(RetiredCIDsBucket).Cursor()
+		for cid, value := c.Seek([]byte(after)); cid != nil && (limit <= 0 || len(retired) < limit); cid, value = c.Next() {
+			if string(cid) == after {
+				continue
+			}
+			r, err := decodeRetiredCID(cid, value)
+			if err != nil {
+				return err
+			}
+			retired = append(retired, r)
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) SetAllowedDomains(id string, domains []string) error {
+	value, err := json.Marshal(domains)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(AllowedDomainsBucket).Put([]byte(id), value)
+	})
+}
+
+func (b *Bolt) GetAllowedDomains(id string) (domains []string, ok bool) {
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket(AllowedDomainsBucket).Get([]byte(id)); value != nil {
+			ok = json.Unmarshal(value, &domains) == nil
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) RemoveAllowedDomains(id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(AllowedDomainsBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return storage.ErrNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (b *Bolt) SetHashedLabel(label string, domain string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(HashedLabelsBucket).Put([]byte(label), []byte(domain))
+	})
+}
+
+func (b *Bolt) GetHashedLabel(label string) (domain string, ok bool) {
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket(HashedLabelsBucket).Get([]byte(label)); value != nil {
+			domain, ok = string(value), true
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) SetDNSChallenge(cid string, label string, challenge string) error {
+	key := challengeKey(cid, label)
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(DNSChallengesBucket)
+		challenges, err := decodeChallenges(bucket.Get(key))
+		if err != nil {
+			return err
+		}
+		for _, c := range challenges {
+			if c.Challenge == challenge {
+				return storage.ErrAlreadyExists
+			}
+		}
+		return putChallenges(bucket, key, append(challenges, dnsChallenge{Challenge: challenge, CreatedAt: time.Now()}))
+	})
+}
+
+func (b *Bolt) GetDNSChallenges(cid string, label string) (challenges []string, ok bool) {
+	key := challengeKey(cid, label)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		decoded, err := decodeChallenges(tx.Bucket(DNSChallengesBucket).Get(key))
+		for _, c := range decoded {
+			challenges = append(challenges, c.Challenge)
+		}
+		return err
+	})
+	if err != nil || len(challenges) == 0 {
+		return nil, false
+	}
+	return challenges, true
+}
+
+func (b *Bolt) RemoveDNSChallenge(cid string, label string, challenge string) error {
+	key := challengeKey(cid, label)
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(DNSChallengesBucket)
+		challenges, err := decodeChallenges(bucket.Get(key))
+		if err != nil {
+			return err
+		}
+		for i, c := range challenges {
+			if c.Challenge == challenge {
+				return putChallenges(bucket, key, append(challenges[:i:i], challenges[i+1:]...))
+			}
+		}
+		return storage.ErrNotFound
+	})
+}
+
+func (b *Bolt) ExpireDNSChallenges(before time.Time) (expired int, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		expired = 0
+		bucket := tx.Bucket(DNSChallengesBucket)
+
+		// buckets cannot be modified while they are being iterated over
+		remaining := make(map[string][]dnsChallenge)
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			challenges, err := decodeChallenges(value)
+			if err != nil {
+				return err
+			}
+			kept := challenges[:0:0]
+			for _, c := range challenges {
+				if c.CreatedAt.Before(before) {
+					continue
+				}
+				kept = append(kept, c)
+			}
+			if len(kept) < len(challenges) {
+				expired += len(challenges) - len(kept)
+				remaining[string(key)] = kept
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for key, challenges := range remaining {
+			if err = putChallenges(bucket, []byte(key), challenges); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func (b *Bolt) ListDNSChallenges(after storage.DNSChallenge, limit int) (challenges []storage.DNSChallenge, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(DNSChallengesBucket).Cursor()
+		for key, value := cursor.Seek(challengeKey(after.CID, after.Label)); key != nil; key, value = cursor.Next() {
+			stored, err := decodeChallenges(value)
+			if err != nil {
+				return err
+			}
+			cid, label, _ := strings.Cut(string(key), "\x00")
+
+			// the challenges of each key are stored in the order that they were set
+			var page []storage.DNSChallenge
+			for _, c := range stored {
+				challenge := storage.DNSChallenge{CID: cid, Label: label, Challenge: c.Challenge, CreatedAt: c.CreatedAt}
+				if after.Less(challenge) {
+					page = append(page, challenge)
+				}
+			}
+			sort.Slice(page, func(i, j int) bool {
+				return page[i].Less(page[j])
+			})
+
+			challenges = append(challenges, page...)
+			if limit > 0 && len(challenges) >= limit {
+				challenges = challenges[:limit]
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return challenges, nil
+}
+
+// initialize creates any missing buckets, and then checks and upgrades the schema version of the database
+func initialize(tx *bbolt.Tx) error {
+	for _, name := range [][]byte{MetaBucket, CIDsBucket, IDsBucket, RetiredCIDsBucket, AllowedDomainsBucket, HashedLabelsBucket, DNSChallengesBucket, CertificatesBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	meta := tx.Bucket(MetaBucket)
+	version := uint64(SchemaVersion)
+	if value := meta.Get(versionKey); value != nil {
+		version = binary.BigEndian.Uint64(value)
+	}
+
+	if version > SchemaVersion {
+		return ErrUnsupportedVersion
+	}
+
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version-1](tx); err != nil {
+			return err
+		}
+	}
+
+	return meta.Put(versionKey, binary.BigEndian.AppendUint64(nil, version))
+}
+
+// putChallenges stores the given challenges under key, deleting the key if there are no challenges left
+func putChallenges(bucket *bbolt.Bucket, key []byte, challenges []dnsChallenge) error {
+	if len(challenges) == 0 {
+		return bucket.Delete(key)
+	}
+	value, err := json.Marshal(challenges)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
+
+// decodeChallenges decodes the challenges stored under a key
+func decodeChallenges(value []byte) (challenges []dnsChallenge, err error) {
+	if value == nil {
+		return nil, nil
+	}
+	err = json.Unmarshal(value, &challenges)
+	return
+}
+
+// decodeRetiredCID decodes the retired CID stored under a key
+func decodeRetiredCID(cid []byte, value []byte) (storage.RetiredCID, error) {
+	var retired retiredCID
+	if err := json.Unmarshal(value, &retired); err != nil {
+		return storage.RetiredCID{}, err
+	}
+	return storage.RetiredCID{CID: string(cid), ID: retired.ID, Until: retired.Until}, nil
+}
+
+// idIndexKey returns the key of the given CID and ID in the IDsBucket
+func idIndexKey(cid string, id string) []byte {
+	return []byte(utils.JoinStrings(cid, "\x00", id))
+}
+
+// challengeKey returns the key of the given CID and label in the DNSChallengesBucket
+func challengeKey(cid string, label string) []byte {
+	return []byte(utils.JoinStrings(cid, "\x00", label))
+}
@@ -0,0 +1,155 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package bolt
+
+import (
+	"encoding/binary"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBolt(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "certifier.db")
+	b, err := New(path)
+	require.NoError(t, err)
+
+	require.NoError(t, b.SetCID("id", "cid"))
+	assert.ErrorIs(t, b.SetCID("id", "other"), storage.ErrAlreadyExists)
+	require.NoError(t, b.SetDNSChallenge("cid", "example-com", "first"))
+	require.NoError(t, b.SetDNSChallenge("cid", "example-com", "second"))
+	assert.ErrorIs(t, b.SetDNSChallenge("cid", "example-com", "second"), storage.ErrAlreadyExists)
+	require.NoError(t, b.RemoveDNSChallenge("cid", "example-com", "first"))
+	require.NoError(t, b.Close())
+
+	b, err = New(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+
+	cid, ok := b.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, "cid", cid)
+
+	challenges, ok := b.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"second"}, challenges)
+
+	require.NoError(t, b.RemoveDNSChallenge("cid", "example-com", "second"))
+	_, ok = b.GetDNSChallenges("cid", "example-com")
+	assert.False(t, ok)
+	assert.ErrorIs(t, b.RemoveDNSChallenge("cid", "example-com", "second"), storage.ErrNotFound)
+
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		assert.NotNil(t, tx.Bucket(CertificatesBucket))
+		assert.Equal(t, uint64(SchemaVersion), binary.BigEndian.Uint64(tx.Bucket(MetaBucket).Get(versionKey)))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBoltUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "certifier.db")
+	b, err := New(path)
+	require.NoError(t, err)
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(MetaBucket).Put(versionKey, binary.BigEndian.AppendUint64(nil, SchemaVersion+1))
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	_, err = New(path)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestBoltUpgrade(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "certifier.db")
+	db, err := bbolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucket(MetaBucket)
+		if err != nil {
+			return err
+		}
+		if err = meta.Put(versionKey, binary.BigEndian.AppendUint64(nil, 1)); err != nil {
+			return err
+		}
+		cids, err := tx.CreateBucket(CIDsBucket)
+		if err != nil {
+			return err
+		}
+		if err = cids.Put([]byte("id"), []byte("cid")); err != nil {
+			return err
+		}
+		challenges, err := tx.CreateBucket(DNSChallengesBucket)
+		if err != nil {
+			return err
+		}
+		return challenges.Put([]byte("example-com.cid"), []byte(`["first","second"]`))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	b, err := New(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+
+	id, ok := b.GetID("cid")
+	require.True(t, ok)
+	assert.Equal(t, "id", id)
+
+	challenges, ok := b.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first", "second"}, challenges)
+
+	listed, err := b.ListDNSChallenges(storage.DNSChallenge{}, 0)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, "cid", listed[0].CID)
+	assert.Equal(t, "example-com", listed[0].Label)
+
+	expired, err := b.ExpireDNSChallenges(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, expired)
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		b, err := New(filepath.Join(t.TempDir(), "certifier.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = b.Close()
+		})
+		return b
+	})
+}
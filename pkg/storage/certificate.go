@@ -0,0 +1,90 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package storage
+
+import (
+	"time"
+)
+
+// Certificate is a certificate obtained by Certifier, along with its private key and metadata
+type Certificate struct {
+	// ID is the ID that the certificate was obtained for
+	ID string `json:"id"`
+
+	// Domain is the primary domain of the certificate
+	Domain string `json:"domain"`
+
+	// Domains are all the domains that the certificate covers
+	Domains []string `json:"domains"`
+
+	// Certificate is the PEM encoded certificate
+	Certificate []byte `json:"certificate"`
+
+	// IssuerCertificate is the PEM encoded certificate chain of the issuer
+	IssuerCertificate []byte `json:"issuer_certificate"`
+
+	// PrivateKey is the PEM encoded private key of the certificate
+	PrivateKey []byte `json:"private_key"`
+
+	// CertURL is the URL that the certificate can be retrieved from on the ACME server
+	CertURL string `json:"cert_url"`
+
+	// Issuer is the Common Name of the certificate's issuer
+	Issuer string `json:"issuer"`
+
+	// NotBefore is the time from which the certificate is valid
+	NotBefore time.Time `json:"not_before"`
+
+	// NotAfter is the time at which the certificate expires
+	NotAfter time.Time `json:"not_after"`
+
+	// Metadata contains any additional information about the certificate
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Copy returns a deep copy of the Certificate
+func (c *Certificate) Copy() *Certificate {
+	cp := *c
+	cp.Domains = append([]string(nil), c.Domains...)
+	cp.Certificate = append([]byte(nil), c.Certificate...)
+	cp.IssuerCertificate = append([]byte(nil), c.IssuerCertificate...)
+	cp.PrivateKey = append([]byte(nil), c.PrivateKey...)
+	if c.Metadata != nil {
+		cp.Metadata = make(map[string]string, len(c.Metadata))
+		for k, v := range c.Metadata {
+			cp.Metadata[k] = v
+		}
+	}
+	return &cp
+}
+
+// CertificateStorage is the storage interface that Certifier uses
+// to persist the certificates it obtains, keyed by ID and primary domain
+type CertificateStorage interface {
+	// SetCertificate stores a certificate, replacing any existing
+	// certificate for the same ID and primary domain
+	SetCertificate(certificate *Certificate) (err error)
+
+	// GetCertificate retrieves the certificate for a given ID and primary domain
+	GetCertificate(id string, domain string) (certificate *Certificate, ok bool)
+
+	// ListCertificates retrieves all the stored certificates
+	ListCertificates() (certificates []*Certificate, err error)
+
+	// RemoveCertificate removes the certificate for a given ID and primary domain
+	RemoveCertificate(id string, domain string) (err error)
+}
@@ -0,0 +1,303 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// ContextStorage is an optional interface that Storage implementations can satisfy when their
+// operations can block (on network or disk access, for example) and should be cancellable
+//
+// The context-taking functions in this package use the ContextStorage methods when they are available,
+// and otherwise fall back to checking the context before calling the regular Storage methods
+type ContextStorage interface {
+	Storage
+
+	// SetCIDContext is the context-aware version of SetCID
+	SetCIDContext(ctx context.Context, id string, cid string) (err error)
+
+	// GetCIDContext is the context-aware version of GetCID
+	GetCIDContext(ctx context.Context, id string) (cid string, ok bool, err error)
+
+	// RemoveCIDContext is the context-aware version of RemoveCID
+	RemoveCIDContext(ctx context.Context, id string) (err error)
+
+	// GetIDContext is the context-aware version of GetID
+	GetIDContext(ctx context.Context, cid string) (id string, ok bool, err error)
+
+	// ListCIDsContext is the context-aware version of ListCIDs
+	ListCIDsContext(ctx context.Context, after string, limit int) (registrations []Registration, err error)
+
+	// RetireCIDContext is the context-aware version of RetireCID
+	RetireCIDContext(ctx context.Context, cid string, id string, until time.Time) (err error)
+
+	// GetRetiredCIDContext is the context-aware version of GetRetiredCID
+	GetRetiredCIDContext(ctx context.Context, cid string) (retired RetiredCID, ok bool, err error)
+
+	// RemoveRetiredCIDContext is the context-aware version of RemoveRetiredCID
+	RemoveRetiredCIDContext(ctx context.Context, cid string) (err error)
+
+	// ListRetiredCIDsContext is the context-aware version of ListRetiredCIDs
+	ListRetiredCIDsContext(ctx context.Context, after string, limit int) (retired []RetiredCID, err error)
+
+	// SetAllowedDomainsContext is the context-aware version of SetAllowedDomains
+	SetAllowedDomainsContext(ctx context.Context, id string, domains []string) (err error)
+
+	// GetAllowedDomainsContext is the context-aware version of GetAllowedDomains
+	GetAllowedDomainsContext(ctx context.Context, id string) (domains []string, ok bool, err error)
+
+	// RemoveAllowedDomainsContext is the context-aware version of RemoveAllowedDomains
+	RemoveAllowedDomainsContext(ctx context.Context, id string) (err error)
+
+	// SetHashedLabelContext is the context-aware version of SetHashedLabel
+	SetHashedLabelContext(ctx context.Context, label string, domain string) (err error)
+
+	// GetHashedLabelContext is the context-aware version of GetHashedLabel
+	GetHashedLabelContext(ctx context.Context, label string) (domain string, ok bool, err error)
+
+	// SetDNSChallengeContext is the context-aware version of SetDNSChallenge
+	SetDNSChallengeContext(ctx context.Context, cid string, label string, challenge string) (err error)
+
+	// GetDNSChallengesContext is the context-aware version of GetDNSChallenges
+	GetDNSChallengesContext(ctx context.Context, cid string, label string) (challenges []string, ok bool, err error)
+
+	// RemoveDNSChallengeContext is the context-aware version of RemoveDNSChallenge
+	RemoveDNSChallengeContext(ctx context.Context, cid string, label string, challenge string) (err error)
+
+	// ExpireDNSChallengesContext is the context-aware version of ExpireDNSChallenges
+	ExpireDNSChallengesContext(ctx context.Context, before time.Time) (expired int, err error)
+
+	// ListDNSChallengesContext is the context-aware version of ListDNSChallenges
+	ListDNSChallengesContext(ctx context.Context, after DNSChallenge, limit int) (challenges []DNSChallenge, err error)
+}
+
+// SetCIDContext calls SetCID on the given Storage unless the context is done
+func SetCIDContext(ctx context.Context, s Storage, id string, cid string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.SetCIDContext(ctx, id, cid)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetCID(id, cid)
+}
+
+// GetCIDContext calls GetCID on the given Storage unless the context is done
+func GetCIDContext(ctx context.Context, s Storage, id string) (string, bool, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetCIDContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	cid, ok := s.GetCID(id)
+	return cid, ok, nil
+}
+
+// RemoveCIDContext calls RemoveCID on the given Storage unless the context is done
+func RemoveCIDContext(ctx context.Context, s Storage, id string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.RemoveCIDContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveCID(id)
+}
+
+// SetDNSChallengeContext calls SetDNSChallenge on the given Storage unless the context is done
+func SetDNSChallengeContext(ctx context.Context, s Storage, cid string, label string, challenge string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.SetDNSChallengeContext(ctx, cid, label, challenge)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetDNSChallenge(cid, label, challenge)
+}
+
+// GetDNSChallengesContext calls GetDNSChallenges on the given Storage unless the context is done
+func GetDNSChallengesContext(ctx context.Context, s Storage, cid string, label string) ([]string, bool, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetDNSChallengesContext(ctx, cid, label)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	challenges, ok := s.GetDNSChallenges(cid, label)
+	return challenges, ok, nil
+}
+
+// RemoveDNSChallengeContext calls RemoveDNSChallenge on the given Storage unless the context is done
+func RemoveDNSChallengeContext(ctx context.Context, s Storage, cid string, label string, challenge string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.RemoveDNSChallengeContext(ctx, cid, label, challenge)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveDNSChallenge(cid, label, challenge)
+}
+
+// ExpireDNSChallengesContext calls ExpireDNSChallenges on the given Storage unless the context is done
+func ExpireDNSChallengesContext(ctx context.Context, s Storage, before time.Time) (int, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.ExpireDNSChallengesContext(ctx, before)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.ExpireDNSChallenges(before)
+}
+
+// GetIDContext calls GetID on the given Storage unless the context is done
+func GetIDContext(ctx context.Context, s Storage, cid string) (string, bool, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetIDContext(ctx, cid)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	id, ok := s.GetID(cid)
+	return id, ok, nil
+}
+
+// ListCIDsContext calls ListCIDs on the given Storage unless the context is done
+func ListCIDsContext(ctx context.Context, s Storage, after string, limit int) ([]Registration, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.ListCIDsContext(ctx, after, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.ListCIDs(after, limit)
+}
+
+// ListDNSChallengesContext calls ListDNSChallenges on the given Storage unless the context is done
+func ListDNSChallengesContext(ctx context.Context, s Storage, after DNSChallenge, limit int) ([]DNSChallenge, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.ListDNSChallengesContext(ctx, after, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.ListDNSChallenges(after, limit)
+}
+
+// RetireCIDContext calls RetireCID on the given Storage unless the context is done
+func RetireCIDContext(ctx context.Context, s Storage, cid string, id string, until time.Time) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.RetireCIDContext(ctx, cid, id, until)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RetireCID(cid, id, until)
+}
+
+// GetRetiredCIDContext calls GetRetiredCID on the given Storage unless the context is done
+func GetRetiredCIDContext(ctx context.Context, s Storage, cid string) (RetiredCID, bool, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetRetiredCIDContext(ctx, cid)
+	}
+	if err := ctx.Err(); err != nil {
+		return RetiredCID{}, false, err
+	}
+	retired, ok := s.GetRetiredCID(cid)
+	return retired, ok, nil
+}
+
+// RemoveRetiredCIDContext calls RemoveRetiredCID on the given Storage unless the context is done
+func RemoveRetiredCIDContext(ctx context.Context, s Storage, cid string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.RemoveRetiredCIDContext(ctx, cid)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveRetiredCID(cid)
+}
+
+// ListRetiredCIDsContext calls ListRetiredCIDs on the given Storage unless the context is done
+func ListRetiredCIDsContext(ctx context.Context, s Storage, after string, limit int) ([]RetiredCID, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.ListRetiredCIDsContext(ctx, after, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.ListRetiredCIDs(after, limit)
+}
+
+// SetAllowedDomainsContext calls SetAllowedDomains on the given Storage unless the context is done
+func SetAllowedDomainsContext(ctx context.Context, s Storage, id string, domains []string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.SetAllowedDomainsContext(ctx, id, domains)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetAllowedDomains(id, domains)
+}
+
+// GetAllowedDomainsContext calls GetAllowedDomains on the given Storage unless the context is done
+func GetAllowedDomainsContext(ctx context.Context, s Storage, id string) ([]string, bool, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetAllowedDomainsContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	domains, ok := s.GetAllowedDomains(id)
+	return domains, ok, nil
+}
+
+// RemoveAllowedDomainsContext calls RemoveAllowedDomains on the given Storage unless the context is done
+func RemoveAllowedDomainsContext(ctx context.Context, s Storage, id string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.RemoveAllowedDomainsContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveAllowedDomains(id)
+}
+
+// SetHashedLabelContext calls SetHashedLabel on the given Storage unless the context is done
+func SetHashedLabelContext(ctx context.Context, s Storage, label string, domain string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.SetHashedLabelContext(ctx, label, domain)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetHashedLabel(label, domain)
+}
+
+// GetHashedLabelContext calls GetHashedLabel on the given Storage unless the context is done
+func GetHashedLabelContext(ctx context.Context, s Storage, label string) (string, bool, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetHashedLabelContext(ctx, label)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	domain, ok := s.GetHashedLabel(label)
+	return domain, ok, nil
+}
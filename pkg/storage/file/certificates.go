@@ -0,0 +1,158 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// CertificateExtension is the file extension used for stored certificates
+	CertificateExtension = ".json"
+)
+
+var _ storage.CertificateStorage = (*Certificates)(nil)
+
+// Certificates is a storage.CertificateStorage implementation that stores every certificate
+// as a separate file, in a directory per ID, under a given root directory
+//
+// File and directory names are hashes of the ID and domain, so the ID and domain are only
+// recorded in the certificate files themselves.
+//
+// Since certificate files contain private keys, they are only readable by the current user
+type Certificates struct {
+	// directory is the root directory that certificates are stored in
+	directory string
+
+	mu sync.RWMutex
+}
+
+// NewCertificates creates a new instance of Certificates that stores certificates
+// in the given directory, creating the directory if it does not exist
+func NewCertificates(directory string) (*Certificates, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &Certificates{
+		directory: directory,
+	}, nil
+}
+
+func (c *Certificates) SetCertificate(certificate *storage.Certificate) error {
+	data, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Join(c.directory, encodeName(certificate.ID))
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeFile(c.path(certificate.ID, certificate.Domain), data, 0600)
+}
+
+func (c *Certificates) GetCertificate(id string, domain string) (*storage.Certificate, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	certificate, err := readCertificate(c.path(id, domain))
+	if err != nil || certificate.ID != id || certificate.Domain != domain {
+		return nil, false
+	}
+	return certificate, true
+}
+
+func (c *Certificates) ListCertificates() ([]*storage.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var certificates []*storage.Certificate
+	err := filepath.WalkDir(c.directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(path) != CertificateExtension {
+			return nil
+		}
+		certificate, err := readCertificate(path)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(certificates, func(i, j int) bool {
+		if certificates[i].ID == certificates[j].ID {
+			return certificates[i].Domain < certificates[j].Domain
+		}
+		return certificates[i].ID < certificates[j].ID
+	})
+	return certificates, nil
+}
+
+func (c *Certificates) RemoveCertificate(id string, domain string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := os.Remove(c.path(id, domain))
+	if errors.Is(err, fs.ErrNotExist) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// the directory for the ID is only removed once it is empty, so failures here are expected
+	_ = os.Remove(filepath.Join(c.directory, encodeName(id)))
+	return nil
+}
+
+// path returns the path of the certificate file for a given ID and domain
+func (c *Certificates) path(id string, domain string) string {
+	return filepath.Join(c.directory, encodeName(id), encodeName(domain)+CertificateExtension)
+}
+
+// readCertificate reads and decodes a certificate file
+func readCertificate(path string) (*storage.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certificate := new(storage.Certificate)
+	if err = json.Unmarshal(data, certificate); err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+// encodeName encodes an ID or domain so that it can be safely used as a file name
+// on any platform, regardless of the characters it contains or its length
+func encodeName(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,102 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package file
+
+import (
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificates(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	c, err := NewCertificates(directory)
+	require.NoError(t, err)
+
+	certificate := &storage.Certificate{
+		ID:          "id/with/slashes",
+		Domain:      "*.example.com",
+		Domains:     []string{"*.example.com", "example.com"},
+		Certificate: []byte("certificate"),
+		PrivateKey:  []byte("private key"),
+		Issuer:      "issuer",
+		NotAfter:    time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	require.NoError(t, c.SetCertificate(certificate))
+
+	info, err := os.Stat(c.path(certificate.ID, certificate.Domain))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// a new instance must be able to read the certificates stored by a previous one
+	c, err = NewCertificates(directory)
+	require.NoError(t, err)
+
+	stored, ok := c.GetCertificate(certificate.ID, certificate.Domain)
+	require.True(t, ok)
+	assert.Equal(t, certificate, stored)
+
+	_, ok = c.GetCertificate(certificate.ID, "example.com")
+	assert.False(t, ok)
+
+	certificates, err := c.ListCertificates()
+	require.NoError(t, err)
+	assert.Equal(t, []*storage.Certificate{certificate}, certificates)
+
+	require.NoError(t, c.RemoveCertificate(certificate.ID, certificate.Domain))
+	assert.ErrorIs(t, c.RemoveCertificate(certificate.ID, certificate.Domain), storage.ErrNotFound)
+
+	certificates, err = c.ListCertificates()
+	require.NoError(t, err)
+	assert.Empty(t, certificates)
+}
+
+func TestLongDomain(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewCertificates(t.TempDir())
+	require.NoError(t, err)
+
+	domain := strings.Repeat(strings.Repeat("a", 63)+".", 3) + "com"
+	certificate := &storage.Certificate{
+		ID:          strings.Repeat("i", 255),
+		Domain:      domain,
+		Domains:     []string{domain},
+		Certificate: []byte("certificate"),
+		PrivateKey:  []byte("private key"),
+		NotAfter:    time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	require.NoError(t, c.SetCertificate(certificate))
+
+	stored, ok := c.GetCertificate(certificate.ID, domain)
+	require.True(t, ok)
+	assert.Equal(t, certificate, stored)
+
+	certificates, err := c.ListCertificates()
+	require.NoError(t, err)
+	assert.Equal(t, []*storage.Certificate{certificate}, certificates)
+
+	require.NoError(t, c.RemoveCertificate(certificate.ID, domain))
+	_, ok = c.GetCertificate(certificate.ID, domain)
+	assert.False(t, ok)
+}
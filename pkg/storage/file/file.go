@@ -0,0 +1,558 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Version is the version of the file format written by File
+	//
+	// Storage files written by earlier versions are upgraded when they are opened
+	Version = 5
+
+	// LockExtension is the extension of the lock file that is created next to the storage file
+	LockExtension = ".lock"
+)
+
+var (
+	// ErrLocked is returned when the storage file is already in use by another File instance or process
+	ErrLocked = errors.New("storage file is locked")
+
+	// ErrUnsupportedVersion is returned when the storage file was written by an unsupported version of File
+	ErrUnsupportedVersion = errors.New("unsupported storage file version")
+
+	// ErrClosed is returned when a File is used after it has been closed
+	ErrClosed = errors.New("storage file is closed")
+)
+
+var _ storage.Storage = (*File)(nil)
+
+// dnsChallenge is a DNS challenge along with the time it was set
+type dnsChallenge struct {
+	Challenge string    `json:"challenge"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// retiredCID is the ID that a retired CID was registered for, along with the end of its grace period
+type retiredCID struct {
+	ID    string    `json:"id"`
+	Until time.Time `json:"until"`
+}
+
+// state is the contents of the storage file
+type state struct {
+	Version        int                       `json:"version"`
+	CIDs           map[string]string         `json:"cids"`
+	RetiredCIDs    map[string]retiredCID     `json:"retired_cids"`
+	AllowedDomains map[string][]string       `json:"allowed_domains"`
+	HashedLabels   map[string]string         `json:"hashed_labels"`
+	DNSChallenges  map[string][]dnsChallenge `json:"dns_challenges"`
+
+	// ids indexes the IDs that each CID is registered for, and is rebuilt from CIDs rather than stored
+	ids map[string]map[string]struct{}
+}
+
+// stateV1 is the contents of a version 1 storage file
+type stateV1 struct {
+	CIDs          map[string]string   `json:"cids"`
+	DNSChallenges map[string][]string `json:"dns_challenges"`
+}
+
+// copy returns a deep copy of the state
+func (s *state) copy() *state {
+	cp := &state{
+		Version:        s.Version,
+		CIDs:           make(map[string]string, len(s.CIDs)),
+		RetiredCIDs:    make(map[string]retiredCID, len(s.RetiredCIDs)),
+		AllowedDomains: make(map[string][]string, len(s.AllowedDomains)),
+		HashedLabels:   make(map[string]string, len(s.HashedLabels)),
+		DNSChallenges:  make(map[string][]dnsChallenge, len(s.DNSChallenges)),
+	}
+	for id, cid := range s.CIDs {
+		cp.CIDs[id] = cid
+	}
+	cp.indexIDs()
+	for cid, retired := range s.RetiredCIDs {
+		cp.RetiredCIDs[cid] = retired
+	}
+	for id, domains := range s.AllowedDomains {
+		cp.AllowedDomains[id] = append([]string(nil), domains...)
+	}
+	for label, domain := range s.HashedLabels {
+		cp.HashedLabels[label] = domain
+	}
+	for key, challenges := range s.DNSChallenges {
+		cp.DNSChallenges[key] = append([]dnsChallenge(nil), challenges...)
+	}
+	return cp
+}
+
+// indexIDs rebuilds the index of the IDs that each CID is registered for
+func (s *state) indexIDs() {
+	s.ids = make(map[string]map[string]struct{}, len(s.CIDs))
+	for id, cid := range s.CIDs {
+		s.addID(cid, id)
+	}
+}
+
+// addID adds the given ID to the index of the IDs that the given CID is registered for
+func (s *state) addID(cid string, id string) {
+	if s.ids[cid] == nil {
+		s.ids[cid] = make(map[string]struct{})
+	}
+	s.ids[cid][id] = struct{}{}
+}
+
+// removeID removes the given ID from the index of the IDs that the given CID is registered for
+func (s *state) removeID(cid string, id string) {
+	delete(s.ids[cid], id)
+	if len(s.ids[cid]) == 0 {
+		delete(s.ids, cid)
+	}
+}
+
+// File is a storage.Storage implementation that persists all of its data to a single JSON file,
+// so that CID registrations survive restarts on single-node deployments
+//
+// Every change is written atomically (to a temporary file which is then renamed over the storage file), and
+// the storage file is locked for as long as the File is open so that only one process can use it at a time
+type File struct {
+	// path is the path of the storage file
+	path string
+
+	// lock is the lock held on the storage file
+	lock *os.File
+
+	state *state
+	mu    sync.RWMutex
+}
+
+// New opens (or creates) the storage file at the given path and locks it
+//
+// ErrLocked is returned if the storage file is already in use, and Close must be called to release the lock
+func New(path string) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	lock, err := acquireLock(path + LockExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := readState(path)
+	if err != nil {
+		_ = releaseLock(lock)
+		return nil, err
+	}
+
+	return &File{
+		path:  path,
+		lock:  lock,
+		state: s,
+	}, nil
+}
+
+// Close releases the lock on the storage file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock == nil {
+		return ErrClosed
+	}
+	err := releaseLock(f.lock)
+	f.lock = nil
+	return err
+}
+
+func (f *File) SetCID(id string, cid string) error {
+	return f.update(func(s *state) error {
+		if _, ok := s.CIDs[id]; ok {
+			return storage.ErrAlreadyExists
+		}
+		s.CIDs[id] = cid
+		s.addID(cid, id)
+		return nil
+	})
+}
+
+func (f *File) GetCID(id string) (cid string, ok bool) {
+	f.mu.RLock()
+	cid, ok = f.state.CIDs[id]
+	f.mu.RUnlock()
+	return
+}
+
+func (f *File) RemoveCID(id string) error {
+	return f.update(func(s *state) error {
+		cid, ok := s.CIDs[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		delete(s.CIDs, id)
+		s.removeID(cid, id)
+		return nil
+	})
+}
+
+func (f *File) GetID(cid string) (id string, ok bool) {
+	f.mu.RLock()
+	for i := range f.state.ids[cid] {
+		if !ok || i < id {
+			id, ok = i, true
+		}
+	}
+	f.mu.RUnlock()
+	return
+}
+
+func (f *File) ListCIDs(after string, limit int) ([]storage.Registration, error) {
+	f.mu.RLock()
+	registrations := make([]storage.Registration, 0, len(f.state.CIDs))
+	for id, cid := range f.state.CIDs {
+		if id > after {
+			registrations = append(registrations, storage.Registration{ID: id, CID: cid})
+		}
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].ID < registrations[j].ID
+	})
+	if limit > 0 && len(registrations) > limit {
+		registrations = registrations[:limit]
+	}
+	return registrations, nil
+}
+
+func (f *File) RetireCID(cid string, id string, until time.Time) error {
+	return f.update(func(s *state) error {
+		if _, ok := s.RetiredCIDs[cid]; ok {
+			return storage.ErrAlreadyExists
+		}
+		s.RetiredCIDs[cid] = retiredCID{ID: id, Until: until}
+		return nil
+	})
+}
+
+func (f *File) GetRetiredCID(cid string) (storage.RetiredCID, bool) {
+	f.mu.RLock()
+	retired, ok := f.state.RetiredCIDs[cid]
+	f.mu.RUnlock()
+	if !ok {
+		return storage.RetiredCID{}, false
+	}
+	return storage.RetiredCID{CID: cid, ID: retired.ID, Until: retired.Until}, true
+}
+
+func (f *File) RemoveRetiredCID(cid string) error {
+	return f.update(func(s *state) error {
+		if _, ok := s.RetiredCIDs[cid]; !ok {
+			return storage.ErrNotFound
+		}
+		delete(s.RetiredCIDs, cid)
+		return nil
+	})
+}
+
+func (f *File) ListRetiredCIDs(after string, limit int) ([]storage.RetiredCID, error) {
+	f.mu.RLock()
+	retired := make([]storage.RetiredCID, 0, len(f.state.RetiredCIDs))
+	for cid, r := range f.state.RetiredCIDs {
+		if cid > after {
+			retired = append(retired, storage.RetiredCID{CID: cid, ID: r.ID, Until: r.Until})
+		}
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(retired, func(i, j int) bool {
+		return retired[i].CID < retired[j].CID
+	})
+	if limit > 0 && len(retired) > limit {
+		retired = retired[:limit]
+	}
+	return retired, nil
+}
+
+func (f *File) SetAllowedDomains(id string, domains []string) error {
+	return f.update(func(s *state) error {
+		s.AllowedDomains[id] = append([]string(nil), domains...)
+		return nil
+	})
+}
+
+func (f *File) GetAllowedDomains(id string) (domains []string, ok bool) {
+	f.mu.RLock()
+	domains, ok = f.state.AllowedDomains[id]
+	domains = append([]string(nil), domains...)
+	f.mu.RUnlock()
+	return
+}
+
+func (f *File) RemoveAllowedDomains(id string) error {
+	return f.update(func(s *state) error {
+		if _, ok := s.AllowedDomains[id]; !ok {
+			return storage.ErrNotFound
+		}
+		delete(s.AllowedDomains, id)
+		return nil
+	})
+}
+
+func (f *File) SetHashedLabel(label string, domain string) error {
+	// the storage file is only rewritten if the hashed label has not already been set
+	if stored, ok := f.GetHashedLabel(label); ok && stored == domain {
+		return nil
+	}
+	return f.update(func(s *state) error {
+		s.HashedLabels[label] = domain
+		return nil
+	})
+}
+
+func (f *File) GetHashedLabel(label string) (domain string, ok bool) {
+	f.mu.RLock()
+	domain, ok = f.state.HashedLabels[label]
+	f.mu.RUnlock()
+	return
+}
+
+func (f *File) SetDNSChallenge(cid string, label string, challenge string) error {
+	key := appendLabelToCID(cid, label)
+	return f.update(func(s *state) error {
+		for _, c := range s.DNSChallenges[key] {
+			if c.Challenge == challenge {
+				return storage.ErrAlreadyExists
+			}
+		}
+		s.DNSChallenges[key] = append(s.DNSChallenges[key], dnsChallenge{Challenge: challenge, CreatedAt: time.Now()})
+		return nil
+	})
+}
+
+func (f *File) GetDNSChallenges(cid string, label string) (challenges []string, ok bool) {
+	f.mu.RLock()
+	for _, c := range f.state.DNSChallenges[appendLabelToCID(cid, label)] {
+		challenges = append(challenges, c.Challenge)
+	}
+	f.mu.RUnlock()
+	return challenges, len(challenges) > 0
+}
+
+func (f *File) RemoveDNSChallenge(cid string, label string, challenge string) error {
+	key := appendLabelToCID(cid, label)
+	return f.update(func(s *state) error {
+		challenges := s.DNSChallenges[key]
+		for i, c := range challenges {
+			if c.Challenge == challenge {
+				if len(challenges) == 1 {
+					delete(s.DNSChallenges, key)
+				} else {
+					s.DNSChallenges[key] = append(challenges[:i:i], challenges[i+1:]...)
+				}
+				return nil
+			}
+		}
+		return storage.ErrNotFound
+	})
+}
+
+func (f *File) ExpireDNSChallenges(before time.Time) (expired int, err error) {
+	f.mu.RLock()
+	for _, challenges := range f.state.DNSChallenges {
+		for _, c := range challenges {
+			if c.CreatedAt.Before(before) {
+				expired++
+			}
+		}
+	}
+	f.mu.RUnlock()
+
+	// avoid rewriting the storage file when there is nothing to expire
+	if expired == 0 {
+		return 0, nil
+	}
+
+	expired = 0
+	err = f.update(func(s *state) error {
+		for key, challenges := range s.DNSChallenges {
+			remaining := challenges[:0:0]
+			for _, c := range challenges {
+				if c.CreatedAt.Before(before) {
+					expired++
+					continue
+				}
+				remaining = append(remaining, c)
+			}
+			if len(remaining) == 0 {
+				delete(s.DNSChallenges, key)
+			} else {
+				s.DNSChallenges[key] = remaining
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func (f *File) ListDNSChallenges(after storage.DNSChallenge, limit int) ([]storage.DNSChallenge, error) {
+	var challenges []storage.DNSChallenge
+	f.mu.RLock()
+	for key, stored := range f.state.DNSChallenges {
+		label, cid := splitLabelFromCID(key)
+		for _, c := range stored {
+			challenge := storage.DNSChallenge{CID: cid, Label: label, Challenge: c.Challenge, CreatedAt: c.CreatedAt}
+			if after.Less(challenge) {
+				challenges = append(challenges, challenge)
+			}
+		}
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(challenges, func(i, j int) bool {
+		return challenges[i].Less(challenges[j])
+	})
+	if limit > 0 && len(challenges) > limit {
+		challenges = challenges[:limit]
+	}
+	return challenges, nil
+}
+
+// update applies fn to a copy of the current state and atomically writes the result to the storage file,
+// only replacing the in-memory state once the write has succeeded
+func (f *File) update(fn func(s *state) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock == nil {
+		return ErrClosed
+	}
+
+	s := f.state.copy()
+	if err := fn(s); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFile(f.path, data, 0600); err != nil {
+		return err
+	}
+
+	f.state = s
+	return nil
+}
+
+// readState reads the storage file at the given path, returning an empty state if it does not exist
+func readState(path string) (*state, error) {
+	s := &state{
+		Version:        Version,
+		CIDs:           make(map[string]string),
+		RetiredCIDs:    make(map[string]retiredCID),
+		AllowedDomains: make(map[string][]string),
+		HashedLabels:   make(map[string]string),
+		DNSChallenges:  make(map[string][]dnsChallenge),
+		ids:            make(map[string]map[string]struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err = json.Unmarshal(data, &version); err != nil {
+		return nil, err
+	}
+
+	switch version.Version {
+	case 1:
+		v1 := new(stateV1)
+		if err = json.Unmarshal(data, v1); err != nil {
+			return nil, err
+		}
+		// version 1 did not record when challenges were set, so they are treated
+		// as having been set when the storage file was upgraded
+		now := time.Now()
+		for id, cid := range v1.CIDs {
+			s.CIDs[id] = cid
+		}
+		for key, challenges := range v1.DNSChallenges {
+			for _, c := range challenges {
+				s.DNSChallenges[key] = append(s.DNSChallenges[key], dnsChallenge{Challenge: c, CreatedAt: now})
+			}
+		}
+	case 2, 3, 4, Version:
+		// versions 3, 4, and 5 only added retired CIDs, allowed domains, and hashed
+		// labels, so version 2, 3, and 4 storage files can be read as-is
+		if err = json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+		s.Version = Version
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+
+	if s.CIDs == nil {
+		s.CIDs = make(map[string]string)
+	}
+	if s.RetiredCIDs == nil {
+		s.RetiredCIDs = make(map[string]retiredCID)
+	}
+	if s.AllowedDomains == nil {
+		s.AllowedDomains = make(map[string][]string)
+	}
+	if s.HashedLabels == nil {
+		s.HashedLabels = make(map[string]string)
+	}
+	if s.DNSChallenges == nil {
+		s.DNSChallenges = make(map[string][]dnsChallenge)
+	}
+	s.indexIDs()
+	return s, nil
+}
+
+func appendLabelToCID(cid string, label string) string {
+	return utils.JoinStrings(label, ".", cid)
+}
+
+func splitLabelFromCID(key string) (label string, cid string) {
+	label, cid, _ = strings.Cut(key, ".")
+	return
+}
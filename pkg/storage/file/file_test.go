@@ -0,0 +1,132 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package file
+
+import (
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "storage", "certifier.json")
+	f, err := New(path)
+	require.NoError(t, err)
+
+	_, err = New(path)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, f.SetCID("id", "cid"))
+	assert.ErrorIs(t, f.SetCID("id", "other"), storage.ErrAlreadyExists)
+	require.NoError(t, f.SetDNSChallenge("cid", "example-com", "first"))
+	require.NoError(t, f.SetDNSChallenge("cid", "example-com", "second"))
+	require.NoError(t, f.RemoveDNSChallenge("cid", "example-com", "first"))
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, f.SetCID("other", "cid"), ErrClosed)
+
+	// reopening the storage file must restore everything that was written to it
+	f, err = New(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	cid, ok := f.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, "cid", cid)
+
+	id, ok := f.GetID("cid")
+	require.True(t, ok)
+	assert.Equal(t, "id", id)
+
+	challenges, ok := f.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"second"}, challenges)
+
+	require.NoError(t, f.RemoveCID("id"))
+	_, ok = f.GetID("cid")
+	assert.False(t, ok)
+	assert.ErrorIs(t, f.RemoveCID("id"), storage.ErrNotFound)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.Contains(t, []string{"certifier.json", "certifier.json" + LockExtension}, entry.Name())
+	}
+}
+
+func TestFileUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "certifier.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1000}`), 0600))
+
+	_, err := New(path)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// a failed open must not leave the storage file locked
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1}`), 0600))
+	f, err := New(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestFileUpgrade(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "certifier.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "cids": {"id": "cid"}, "dns_challenges": {"example-com.cid": ["first", "second"]}}`), 0600))
+
+	f, err := New(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	cid, ok := f.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, "cid", cid)
+
+	challenges, ok := f.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first", "second"}, challenges)
+
+	// upgraded challenges can still be expired
+	expired, err := f.ExpireDNSChallenges(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, expired)
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		f, err := New(filepath.Join(t.TempDir(), "certifier.json"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = f.Close()
+		})
+		return f
+	})
+}
@@ -0,0 +1,52 @@
+//go:build !unix
+
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package file
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// acquireLock exclusively creates the lock file at the given path
+//
+// Unlike the advisory locks used on unix systems, the lock file is not removed if the
+// process exits without calling Close, and must then be removed manually
+func acquireLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, ErrLocked
+	}
+	return f, err
+}
+
+// releaseLock removes the lock file created by acquireLock
+func releaseLock(f *os.File) error {
+	err := f.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// syncDir is a no-op since directories cannot be opened and synced on
+// non-unix systems such as windows
+func syncDir(string) error {
+	return nil
+}
@@ -0,0 +1,587 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package sql is a storage.Storage implementation backed by a database/sql database,
+// which allows multiple Certifier replicas to share the same CIDs and DNS challenges
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrUnsupportedVersion is returned when the database schema was created by a newer version of SQL
+	ErrUnsupportedVersion = errors.New("unsupported database schema version")
+)
+
+// Dialect describes the differences between the SQL databases supported by SQL
+type Dialect struct {
+	// Name is the name of the Dialect
+	Name string
+
+	// Placeholder returns the bind parameter for the n-th (starting at 1) argument of a query
+	Placeholder func(n int) string
+}
+
+var (
+	// SQLite is the Dialect for SQLite databases
+	SQLite = Dialect{Name: "sqlite", Placeholder: questionPlaceholder}
+
+	// Postgres is the Dialect for PostgreSQL databases
+	Postgres = Dialect{Name: "postgres", Placeholder: dollarPlaceholder}
+
+	// MySQL is the Dialect for MySQL and MariaDB databases
+	MySQL = Dialect{Name: "mysql", Placeholder: questionPlaceholder}
+)
+
+// migrations contains the statements that upgrade the database schema, where
+// migrations[i] upgrades the schema from version i to version i+1
+var migrations = [][]string{
+	{
+		`CREATE TABLE certifier_cids (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			cid VARCHAR(255) NOT NULL
+		)`,
+		`CREATE INDEX certifier_cids_cid ON certifier_cids (cid)`,
+		`CREATE TABLE certifier_dns_challenges (
+			cid VARCHAR(255) NOT NULL,
+			domain VARCHAR(255) NOT NULL,
+			challenge VARCHAR(255) NOT NULL,
+			created_at BIGINT NOT NULL,
+			PRIMARY KEY (cid, domain, challenge)
+		)`,
+	},
+	{
+		`CREATE INDEX certifier_dns_challenges_created_at ON certifier_dns_challenges (created_at)`,
+	},
+	{
+		`CREATE TABLE certifier_retired_cids (
+			cid VARCHAR(255) NOT NULL PRIMARY KEY,
+			id VARCHAR(255) NOT NULL,
+			until_time BIGINT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE certifier_allowed_domains (
+			id VARCHAR(255) NOT NULL,
+			domain VARCHAR(255) NOT NULL,
+			PRIMARY KEY (id, domain)
+		)`,
+	},
+	{
+		`CREATE TABLE certifier_hashed_labels (
+			label VARCHAR(63) NOT NULL PRIMARY KEY,
+			domain VARCHAR(255) NOT NULL
+		)`,
+	},
+}
+
+var _ storage.ContextStorage = (*SQL)(nil)
+
+// SQL is a storage.Storage implementation that stores CIDs and DNS challenges in a database/sql database
+//
+// The uniqueness of IDs and of challenges for a CID and domain is enforced by the primary keys of
+// their tables, so that multiple Certifier replicas can safely share the same database
+type SQL struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// New creates a new instance of SQL given a database and its Dialect,
+// creating or upgrading the database schema if necessary
+func New(db *sql.DB, dialect Dialect) (*SQL, error) {
+	return NewContext(context.Background(), db, dialect)
+}
+
+// NewContext is the context-aware version of New
+func NewContext(ctx context.Context, db *sql.DB, dialect Dialect) (*SQL, error) {
+	s := &SQL{
+		db:      db,
+		dialect: dialect,
+	}
+
+	if err := s.migrate(ctx); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SQL) SetCID(id string, cid string) error {
+	return s.SetCIDContext(context.Background(), id, cid)
+}
+
+func (s *SQL) SetCIDContext(ctx context.Context, id string, cid string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO certifier_cids (id, cid) VALUES (?, ?)`), id, cid)
+	if err != nil {
+		return s.conflict(ctx, err, `SELECT 1 FROM certifier_cids WHERE id = ?`, id)
+	}
+	return nil
+}
+
+func (s *SQL) GetCID(id string) (cid string, ok bool) {
+	cid, ok, _ = s.GetCIDContext(context.Background(), id)
+	return
+}
+
+func (s *SQL) GetCIDContext(ctx context.Context, id string) (string, bool, error) {
+	var cid string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT cid FROM certifier_cids WHERE id = ?`), id).Scan(&cid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return cid, true, nil
+}
+
+func (s *SQL) RemoveCID(id string) error {
+	return s.RemoveCIDContext(context.Background(), id)
+}
+
+func (s *SQL) RemoveCIDContext(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM certifier_cids WHERE id = ?`), id)
+	return affected(result, err)
+}
+
+func (s *SQL) GetID(cid string) (id string, ok bool) {
+	id, ok, _ = s.GetIDContext(context.Background(), cid)
+	return
+}
+
+func (s *SQL) GetIDContext(ctx context.Context, cid string) (string, bool, error) {
+	// MIN returns NULL when the CID is not registered for any ID
+	var id sql.NullString
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT MIN(id) FROM certifier_cids WHERE cid = ?`), cid).Scan(&id)
+	if err != nil {
+		return "", false, err
+	}
+	return id.String, id.Valid, nil
+}
+
+func (s *SQL) ListCIDs(after string, limit int) ([]storage.Registration, error) {
+	return s.ListCIDsContext(context.Background(), after, limit)
+}
+
+func (s *SQL) ListCIDsContext(ctx context.Context, after string, limit int) ([]storage.Registration, error) {
+	query, args := withLimit(`SELECT id, cid FROM certifier_cids WHERE id > ? ORDER BY id`, limit, after)
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var registrations []storage.Registration
+	for rows.Next() {
+		var registration storage.Registration
+		if err = rows.Scan(&registration.ID, &registration.CID); err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, registration)
+	}
+	return registrations, rows.Err()
+}
+
+func (s *SQL) RetireCID(cid string, id string, until time.Time) error {
+	return s.RetireCIDContext(context.Background(), cid, id, until)
+}
+
+func (s *SQL) RetireCIDContext(ctx context.Context, cid string, id string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO certifier_retired_cids (cid, id, until_time) VALUES (?, ?, ?)`), cid, id, until.UnixNano())
+	if err != nil {
+		return s.conflict(ctx, err, `SELECT 1 FROM certifier_retired_cids WHERE cid = ?`, cid)
+	}
+	return nil
+}
+
+func (s *SQL) GetRetiredCID(cid string) (retired storage.RetiredCID, ok bool) {
+	retired, ok, _ = s.GetRetiredCIDContext(context.Background(), cid)
+	return
+}
+
+func (s *SQL) GetRetiredCIDContext(ctx context.Context, cid string) (storage.RetiredCID, bool, error) {
+	retired := storage.RetiredCID{CID: cid}
+	var until int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT id, until_time FROM certifier_retired_cids WHERE cid = ?`), cid).Scan(&retired.ID, &until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.RetiredCID{}, false, nil
+	}
+	if err != nil {
+		return storage.RetiredCID{}, false, err
+	}
+	retired.Until = time.Unix(0, until)
+	return retired, true, nil
+}
+
+func (s *SQL) RemoveRetiredCID(cid string) error {
+	return s.RemoveRetiredCIDContext(context.Background(), cid)
+}
+
+func (s *SQL) RemoveRetiredCIDContext(ctx context.Context, cid string) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM certifier_retired_cids WHERE cid = ?`), cid)
+	return affected(result, err)
+}
+
+func (s *SQL) ListRetiredCIDs(after string, limit int) ([]storage.RetiredCID, error) {
+	return s.ListRetiredCIDsContext(context.Background(), after, limit)
+}
+
+func (s *SQL) ListRetiredCIDsContext(ctx context.Context, after string, limit int) ([]storage.RetiredCID, error) {
+	query, args := withLimit(`SELECT cid, id, until_time FROM certifier_retired_cids WHERE cid > ? ORDER BY cid`, limit, after)
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var retired []storage.RetiredCID
+	for rows.Next() {
+		var r storage.RetiredCID
+		var until int64
+		if err = rows.Scan(&r.CID, &r.ID, &until); err != nil {
+			return nil, err
+		}
+		r.Until = time.Unix(0, until)
+		retired = append(retired, r)
+	}
+	return retired, rows.Err()
+}
+
+func (s *SQL) SetAllowedDomains(id string, domains []string) error {
+	return s.SetAllowedDomainsContext(context.Background(), id, domains)
+}
+
+func (s *SQL) SetAllowedDomainsContext(ctx context.Context, id string, domains []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM certifier_allowed_domains WHERE id = ?`), id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	seen := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO certifier_allowed_domains (id, domain) VALUES (?, ?)`), id, domain)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQL) GetAllowedDomains(id string) (domains []string, ok bool) {
+	domains, ok, _ = s.GetAllowedDomainsContext(context.Background(), id)
+	return
+}
+
+func (s *SQL) GetAllowedDomainsContext(ctx context.Context, id string) ([]string, bool, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT domain FROM certifier_allowed_domains WHERE id = ? ORDER BY domain`), id)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err = rows.Scan(&domain); err != nil {
+			return nil, false, err
+		}
+		domains = append(domains, domain)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return domains, len(domains) > 0, nil
+}
+
+func (s *SQL) RemoveAllowedDomains(id string) error {
+	return s.RemoveAllowedDomainsContext(context.Background(), id)
+}
+
+func (s *SQL) RemoveAllowedDomainsContext(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM certifier_allowed_domains WHERE id = ?`), id)
+	return affected(result, err)
+}
+
+func (s *SQL) SetHashedLabel(label string, domain string) error {
+	return s.SetHashedLabelContext(context.Background(), label, domain)
+}
+
+func (s *SQL) SetHashedLabelContext(ctx context.Context, label string, domain string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO certifier_hashed_labels (label, domain) VALUES (?, ?)`), label, domain)
+	if err != nil {
+		err = s.conflict(ctx, err, `SELECT 1 FROM certifier_hashed_labels WHERE label = ?`, label)
+		if errors.Is(err, storage.ErrAlreadyExists) {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *SQL) GetHashedLabel(label string) (domain string, ok bool) {
+	domain, ok, _ = s.GetHashedLabelContext(context.Background(), label)
+	return
+}
+
+func (s *SQL) GetHashedLabelContext(ctx context.Context, label string) (string, bool, error) {
+	var domain string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT domain FROM certifier_hashed_labels WHERE label = ?`), label).Scan(&domain)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return domain, true, nil
+}
+
+func (s *SQL) SetDNSChallenge(cid string, label string, challenge string) error {
+	return s.SetDNSChallengeContext(context.Background(), cid, label, challenge)
+}
+
+func (s *SQL) SetDNSChallengeContext(ctx context.Context, cid string, label string, challenge string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO certifier_dns_challenges (cid, domain, challenge, created_at) VALUES (?, ?, ?, ?)`), cid, label, challenge, timestamp())
+	if err != nil {
+		return s.conflict(ctx, err, `SELECT 1 FROM certifier_dns_challenges WHERE cid = ? AND domain = ? AND challenge = ?`, cid, label, challenge)
+	}
+	return nil
+}
+
+func (s *SQL) GetDNSChallenges(cid string, label string) (challenges []string, ok bool) {
+	challenges, ok, _ = s.GetDNSChallengesContext(context.Background(), cid, label)
+	return
+}
+
+func (s *SQL) GetDNSChallengesContext(ctx context.Context, cid string, label string) ([]string, bool, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT challenge FROM certifier_dns_challenges WHERE cid = ? AND domain = ? ORDER BY created_at, challenge`), cid, label)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var challenges []string
+	for rows.Next() {
+		var challenge string
+		if err = rows.Scan(&challenge); err != nil {
+			return nil, false, err
+		}
+		challenges = append(challenges, challenge)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return challenges, len(challenges) > 0, nil
+}
+
+func (s *SQL) RemoveDNSChallenge(cid string, label string, challenge string) error {
+	return s.RemoveDNSChallengeContext(context.Background(), cid, label, challenge)
+}
+
+func (s *SQL) RemoveDNSChallengeContext(ctx context.Context, cid string, label string, challenge string) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM certifier_dns_challenges WHERE cid = ? AND domain = ? AND challenge = ?`), cid, label, challenge)
+	return affected(result, err)
+}
+
+func (s *SQL) ExpireDNSChallenges(before time.Time) (int, error) {
+	return s.ExpireDNSChallengesContext(context.Background(), before)
+}
+
+func (s *SQL) ExpireDNSChallengesContext(ctx context.Context, before time.Time) (int, error) {
+	result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM certifier_dns_challenges WHERE created_at < ?`), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	expired, err := result.RowsAffected()
+	return int(expired), err
+}
+
+func (s *SQL) ListDNSChallenges(after storage.DNSChallenge, limit int) ([]storage.DNSChallenge, error) {
+	return s.ListDNSChallengesContext(context.Background(), after, limit)
+}
+
+func (s *SQL) ListDNSChallengesContext(ctx context.Context, after storage.DNSChallenge, limit int) ([]storage.DNSChallenge, error) {
+	query, args := withLimit(`SELECT cid, domain, challenge, created_at FROM certifier_dns_challenges
+		WHERE cid > ? OR (cid = ? AND domain > ?) OR (cid = ? AND domain = ? AND challenge > ?)
+		ORDER BY cid, domain, challenge`, limit,
+		after.CID, after.CID, after.Label, after.CID, after.Label, after.Challenge)
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var challenges []storage.DNSChallenge
+	for rows.Next() {
+		var challenge storage.DNSChallenge
+		var createdAt int64
+		if err = rows.Scan(&challenge.CID, &challenge.Label, &challenge.Challenge, &createdAt); err != nil {
+			return nil, err
+		}
+		challenge.CreatedAt = time.Unix(0, createdAt)
+		challenges = append(challenges, challenge)
+	}
+	return challenges, rows.Err()
+}
+
+// migrate creates the schema version table if it does not exist, and then applies
+// any migrations that have not yet been applied, each in its own transaction
+func (s *SQL) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS certifier_schema_version (version INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM certifier_schema_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return ErrUnsupportedVersion
+	}
+
+	for ; version < len(migrations); version++ {
+		if err = s.apply(ctx, version+1, migrations[version]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply runs the statements of a single migration and records the resulting schema version
+//
+// Since recording the version uses the primary key of the version table, replicas that try to apply
+// the same migration at the same time will fail (and roll back) rather than applying it twice
+func (s *SQL) apply(ctx context.Context, version int, statements []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range statements {
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO certifier_schema_version (version) VALUES (?)`), version); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// conflict is called when an insert fails, and returns storage.ErrAlreadyExists if the row that was being inserted
+// (as selected by query) now exists, since that means the insert violated a primary key, otherwise returning err
+//
+// This avoids having to parse the driver-specific errors that are returned when a constraint is violated
+func (s *SQL) conflict(ctx context.Context, err error, query string, args ...interface{}) error {
+	var exists int
+	if s.db.QueryRowContext(ctx, s.rebind(query), args...).Scan(&exists) == nil {
+		return storage.ErrAlreadyExists
+	}
+	return err
+}
+
+// withLimit appends a LIMIT clause to a query if limit is greater than zero, returning the query and its arguments
+func withLimit(query string, limit int, args ...interface{}) (string, []interface{}) {
+	if limit <= 0 {
+		return query, args
+	}
+	return query + ` LIMIT ?`, append(args, limit)
+}
+
+// rebind replaces the question mark bind parameters in a query with the placeholders of the Dialect
+func (s *SQL) rebind(query string) string {
+	if s.dialect.Placeholder == nil {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(s.dialect.Placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// affected returns storage.ErrNotFound if a statement did not affect any rows
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// lastTimestamp is the last timestamp returned by timestamp
+var lastTimestamp atomic.Int64
+
+// timestamp returns the current time in nanoseconds, making sure that every call within a process returns
+// a later timestamp than the previous one, so that challenges are always returned in the order that they were set
+func timestamp() int64 {
+	for {
+		last := lastTimestamp.Load()
+		now := time.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if lastTimestamp.CompareAndSwap(last, now) {
+			return now
+		}
+	}
+}
+
+func questionPlaceholder(int) string {
+	return "?"
+}
+
+func dollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
@@ -0,0 +1,129 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newSQLite opens a new SQLite database in a temporary directory
+func newSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "certifier.db")+"?_busy_timeout=5000&_journal_mode=WAL")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func TestSQL(t *testing.T) {
+	t.Parallel()
+
+	db := newSQLite(t)
+	s, err := New(db, SQLite)
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetCID("id", "cid"))
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "first"))
+
+	// a second replica sharing the same database must not re-apply any migrations,
+	// and must see everything written by the first replica
+	replica, err := New(db, SQLite)
+	require.NoError(t, err)
+
+	cid, ok := replica.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, "cid", cid)
+
+	challenges, ok := replica.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first"}, challenges)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, storage.SetCIDContext(ctx, replica, "other", "cid"), context.Canceled)
+
+	_, err = db.Exec(`INSERT INTO certifier_schema_version (version) VALUES (?)`, len(migrations)+1)
+	require.NoError(t, err)
+	_, err = New(db, SQLite)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestSQLConcurrentReplicas(t *testing.T) {
+	t.Parallel()
+
+	db := newSQLite(t)
+	first, err := New(db, SQLite)
+	require.NoError(t, err)
+	second, err := New(db, SQLite)
+	require.NoError(t, err)
+
+	const attempts = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts*2)
+	for i := 0; i < attempts; i++ {
+		for _, s := range []*SQL{first, second} {
+			wg.Add(1)
+			go func(s *SQL) {
+				defer wg.Done()
+				errs <- s.SetCID("id", "cid")
+			}(s)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+func TestRebind(t *testing.T) {
+	t.Parallel()
+
+	s := &SQL{dialect: Postgres}
+	assert.Equal(t, "SELECT 1 WHERE a = $1 AND b = $2", s.rebind("SELECT 1 WHERE a = ? AND b = ?"))
+
+	s = &SQL{dialect: SQLite}
+	assert.Equal(t, "SELECT 1 WHERE a = ? AND b = ?", s.rebind("SELECT 1 WHERE a = ? AND b = ?"))
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := New(newSQLite(t), SQLite)
+		require.NoError(t, err)
+		return s
+	})
+}
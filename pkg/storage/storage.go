@@ -20,6 +20,7 @@ package storage
 
 import (
 	"errors"
+	"time"
 )
 
 var (
@@ -30,6 +31,47 @@ var (
 	ErrAlreadyExists = errors.New("already exists")
 )
 
+// Registration is a CID that has been registered for an ID
+type Registration struct {
+	ID  string
+	CID string
+}
+
+// RetiredCID is a CID that has been replaced, but that remains valid
+// until its grace period ends so that users have time to update their DNS records
+type RetiredCID struct {
+	CID string
+
+	// ID is the ID that the CID was registered for
+	ID string
+
+	// Until is the time at which the grace period of the CID ends
+	Until time.Time
+}
+
+// DNSChallenge is a DNS challenge that is currently stored for a CID and label
+type DNSChallenge struct {
+	CID string
+
+	// Label is the encoded domain label (see utils.EncodeDomain) the challenge was set for
+	Label string
+
+	Challenge string
+	CreatedAt time.Time
+}
+
+// Less reports whether c is ordered before o when listing DNS challenges,
+// which are ordered by CID, then by Label, and then by Challenge
+func (c DNSChallenge) Less(o DNSChallenge) bool {
+	if c.CID != o.CID {
+		return c.CID < o.CID
+	}
+	if c.Label != o.Label {
+		return c.Label < o.Label
+	}
+	return c.Challenge < o.Challenge
+}
+
 // Storage is the storage interface that Certifier uses
 // to map CIDs with User IDs and work with DNS-01 Challenges
 type Storage interface {
@@ -42,18 +84,86 @@ type Storage interface {
 	// RemoveCID removes the CID for a given ID
 	RemoveCID(id string) (err error)
 
-	// SetDNSChallenge sets the DNS challenge string given a CID and a domain
+	// GetID retrieves the ID that a given CID was registered for
+	//
+	// If the same CID was registered for more than one ID, the lowest ID is returned
+	GetID(cid string) (id string, ok bool)
+
+	// ListCIDs returns up to limit registrations ordered by ID, starting with the first
+	// ID that is greater than after, so that the ID of the last registration can be used
+	// to retrieve the next page
+	//
+	// An empty after starts from the beginning, and if limit is less than or equal to zero,
+	// all the remaining registrations are returned
+	ListCIDs(after string, limit int) (registrations []Registration, err error)
+
+	// RetireCID records that a CID which was registered for the given ID remains valid until the given time
 	//
-	// It is the responsibility of the implementation to normalize the given domain (replace periods with hyphens)
-	SetDNSChallenge(cid string, domain string, challenge string) (err error)
+	// ErrAlreadyExists must be returned if the CID has already been retired
+	RetireCID(cid string, id string, until time.Time) (err error)
+
+	// GetRetiredCID retrieves a retired CID, regardless of whether its grace period has ended
+	GetRetiredCID(cid string) (retired RetiredCID, ok bool)
+
+	// RemoveRetiredCID removes a retired CID, ending its grace period immediately
+	RemoveRetiredCID(cid string) (err error)
+
+	// ListRetiredCIDs returns up to limit retired CIDs ordered by CID, starting with the first
+	// CID that is greater than after, following the same paging rules as ListCIDs
+	ListRetiredCIDs(after string, limit int) (retired []RetiredCID, err error)
+
+	// SetAllowedDomains sets the domain patterns (such as example.com or *.example.com) that certificates
+	// may be obtained for using the CIDs of a given ID, replacing any patterns that were previously set
+	//
+	// The given domains are never empty
+	SetAllowedDomains(id string, domains []string) (err error)
+
+	// GetAllowedDomains retrieves the domain patterns that were set for a given ID, in no particular order
+	GetAllowedDomains(id string) (domains []string, ok bool)
+
+	// RemoveAllowedDomains removes the domain patterns that were set for a given ID
+	RemoveAllowedDomains(id string) (err error)
+
+	// SetHashedLabel records the domain that a hashed label (see utils.HashedLabel) was generated for, since hashed
+	// labels cannot be decoded and the DNS server needs the domain to check it against the allowed domains of an ID
+	//
+	// Setting a hashed label that has already been set must not return an error
+	SetHashedLabel(label string, domain string) (err error)
+
+	// GetHashedLabel retrieves the domain that a hashed label was generated for
+	GetHashedLabel(label string) (domain string, ok bool)
+
+	// SetDNSChallenge adds a DNS challenge string given a CID and a label
+	//
+	// Multiple challenges can be stored for the same CID and label at the same time (for example, when
+	// a certificate is requested for both example.com and *.example.com), so ErrAlreadyExists must only be
+	// returned when the given challenge string is already stored for the CID and label
+	//
+	// The label is a domain that has already been encoded into a single DNS label (see utils.ChallengeLabels),
+	// and must be stored exactly as given
+	SetDNSChallenge(cid string, label string, challenge string) (err error)
+
+	// GetDNSChallenges retrieves all the DNS challenge strings given a CID and a label,
+	// in the order that they were set
+	GetDNSChallenges(cid string, label string) (challenges []string, ok bool)
+
+	// RemoveDNSChallenge removes a single DNS challenge string given a CID and a label, leaving
+	// any other challenges for the same CID and label in place
+	RemoveDNSChallenge(cid string, label string, challenge string) (err error)
 
-	// GetDNSChallenge retrieves the DNS challenge string given a CID and a domain
+	// ExpireDNSChallenges removes every DNS challenge that was set before the given time, and returns
+	// the number of challenges that were removed
 	//
-	// It is the responsibility of the implementation to normalize the given domain (replace periods with hyphens)
-	GetDNSChallenge(cid string, domain string) (challenge string, ok bool)
+	// Challenges are normally removed once they have been validated, so this is only needed to clean up
+	// challenges that were left behind (for example, when a process crashes part way through an order).
+	// Implementations that natively expire challenges can return immediately.
+	ExpireDNSChallenges(before time.Time) (expired int, err error)
 
-	// RemoveDNSChallenge removes the DNS challenge string given a CID and a domain
+	// ListDNSChallenges returns up to limit stored DNS challenges in the order defined by DNSChallenge.Less,
+	// starting with the first challenge that is ordered after the given one, so that the last challenge
+	// can be used to retrieve the next page
 	//
-	// It is the responsibility of the implementation to normalize the given domain (replace periods with hyphens)
-	RemoveDNSChallenge(cid string, domain string) (err error)
+	// The zero DNSChallenge starts from the beginning, and if limit is less than or equal to zero,
+	// all the remaining challenges are returned
+	ListDNSChallenges(after DNSChallenge, limit int) (challenges []DNSChallenge, err error)
 }
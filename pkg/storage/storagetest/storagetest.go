@@ -0,0 +1,511 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package storagetest contains a conformance test suite that
+// every storage.Storage implementation is expected to pass
+//
+// Backend authors can run the suite from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return mybackend.New()
+//		})
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/certifier/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrency is the number of goroutines used by the concurrency tests
+const Concurrency = 32
+
+// Factory returns a new, empty storage.Storage instance for a single test,
+// and is responsible for registering any cleanup it requires with t.Cleanup
+type Factory func(t *testing.T) storage.Storage
+
+// Run runs the full conformance test suite, calling factory to get a new storage.Storage for every test
+func Run(t *testing.T, factory Factory) {
+	t.Run("CID", func(t *testing.T) {
+		testCID(t, factory(t))
+	})
+	t.Run("CIDIsolation", func(t *testing.T) {
+		testCIDIsolation(t, factory(t))
+	})
+	t.Run("GetID", func(t *testing.T) {
+		testGetID(t, factory(t))
+	})
+	t.Run("ListCIDs", func(t *testing.T) {
+		testListCIDs(t, factory(t))
+	})
+	t.Run("RetiredCID", func(t *testing.T) {
+		testRetiredCID(t, factory(t))
+	})
+	t.Run("AllowedDomains", func(t *testing.T) {
+		testAllowedDomains(t, factory(t))
+	})
+	t.Run("HashedLabel", func(t *testing.T) {
+		testHashedLabel(t, factory(t))
+	})
+	t.Run("DNSChallenge", func(t *testing.T) {
+		testDNSChallenge(t, factory(t))
+	})
+	t.Run("DNSChallengeLabels", func(t *testing.T) {
+		testDNSChallengeLabels(t, factory(t))
+	})
+	t.Run("DNSChallengeIsolation", func(t *testing.T) {
+		testDNSChallengeIsolation(t, factory(t))
+	})
+	t.Run("ExpireDNSChallenges", func(t *testing.T) {
+		testExpireDNSChallenges(t, factory(t))
+	})
+	t.Run("ListDNSChallenges", func(t *testing.T) {
+		testListDNSChallenges(t, factory(t))
+	})
+	t.Run("ConcurrentSetCID", func(t *testing.T) {
+		testConcurrentSetCID(t, factory(t))
+	})
+	t.Run("ConcurrentDNSChallenges", func(t *testing.T) {
+		testConcurrentDNSChallenges(t, factory(t))
+	})
+}
+
+// testCID checks the error semantics of SetCID, GetCID, and RemoveCID
+func testCID(t *testing.T, s storage.Storage) {
+	_, ok := s.GetCID("id")
+	assert.False(t, ok, "GetCID must not find an ID that was never set")
+	assert.ErrorIs(t, s.RemoveCID("id"), storage.ErrNotFound, "RemoveCID must return ErrNotFound for an ID that was never set")
+
+	require.NoError(t, s.SetCID("id", "cid"))
+	assert.ErrorIs(t, s.SetCID("id", "cid"), storage.ErrAlreadyExists, "SetCID must return ErrAlreadyExists for an ID that is already set")
+	assert.ErrorIs(t, s.SetCID("id", "other"), storage.ErrAlreadyExists, "SetCID must not overwrite the CID of an existing ID")
+
+	cid, ok := s.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, "cid", cid)
+
+	require.NoError(t, s.RemoveCID("id"))
+	_, ok = s.GetCID("id")
+	assert.False(t, ok, "GetCID must not find a removed ID")
+	assert.ErrorIs(t, s.RemoveCID("id"), storage.ErrNotFound, "RemoveCID must return ErrNotFound for a removed ID")
+
+	require.NoError(t, s.SetCID("id", "other"), "SetCID must succeed for a removed ID")
+	cid, ok = s.GetCID("id")
+	require.True(t, ok)
+	assert.Equal(t, "other", cid)
+}
+
+// testCIDIsolation checks that changes to one ID do not affect any other ID
+func testCIDIsolation(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.SetCID("first", "first-cid"))
+	require.NoError(t, s.SetCID("second", "second-cid"))
+
+	require.NoError(t, s.RemoveCID("first"))
+
+	cid, ok := s.GetCID("second")
+	require.True(t, ok, "RemoveCID must not remove other IDs")
+	assert.Equal(t, "second-cid", cid)
+
+	_, ok = s.GetCID("first-cid")
+	assert.False(t, ok, "GetCID must look up IDs, not CIDs")
+}
+
+// testGetID checks that GetID finds the ID that a CID was registered for
+func testGetID(t *testing.T, s storage.Storage) {
+	_, ok := s.GetID("cid")
+	assert.False(t, ok, "GetID must not find a CID that was never set")
+
+	require.NoError(t, s.SetCID("id", "cid"))
+	require.NoError(t, s.SetCID("other", "other-cid"))
+
+	id, ok := s.GetID("cid")
+	require.True(t, ok)
+	assert.Equal(t, "id", id)
+
+	// a CID registered for more than one ID resolves to the lowest ID
+	require.NoError(t, s.SetCID("another", "cid"))
+	id, ok = s.GetID("cid")
+	require.True(t, ok)
+	assert.Equal(t, "another", id, "GetID must return the lowest ID when a CID is registered for more than one ID")
+
+	require.NoError(t, s.RemoveCID("another"))
+	require.NoError(t, s.RemoveCID("id"))
+	_, ok = s.GetID("cid")
+	assert.False(t, ok, "GetID must not find a CID once every ID it was registered for is removed")
+}
+
+// testListCIDs checks that ListCIDs pages through every registration in order of ID
+func testListCIDs(t *testing.T, s storage.Storage) {
+	registrations, err := s.ListCIDs("", 0)
+	require.NoError(t, err)
+	assert.Empty(t, registrations)
+
+	var expected []storage.Registration
+	for i := 0; i < 5; i++ {
+		registration := storage.Registration{ID: fmt.Sprintf("id-%d", i), CID: fmt.Sprintf("cid-%d", i)}
+		expected = append(expected, registration)
+	}
+	// IDs are set out of order to make sure they are sorted when listed
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		require.NoError(t, s.SetCID(expected[i].ID, expected[i].CID))
+	}
+
+	registrations, err = s.ListCIDs("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, expected, registrations, "ListCIDs must return every registration when limit is zero")
+
+	var paged []storage.Registration
+	after := ""
+	for {
+		page, err := s.ListCIDs(after, 2)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page), 2, "ListCIDs must not return more than limit registrations")
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = page[len(page)-1].ID
+	}
+	assert.Equal(t, expected, paged, "paging through ListCIDs must return every registration exactly once")
+}
+
+// testRetiredCID checks the error semantics of RetireCID, GetRetiredCID, and RemoveRetiredCID,
+// and that ListRetiredCIDs pages through every retired CID in order
+func testRetiredCID(t *testing.T, s storage.Storage) {
+	_, ok := s.GetRetiredCID("cid")
+	assert.False(t, ok, "GetRetiredCID must not find a CID that was never retired")
+	assert.ErrorIs(t, s.RemoveRetiredCID("cid"), storage.ErrNotFound, "RemoveRetiredCID must return ErrNotFound for a CID that was never retired")
+
+	until := time.Now().Add(time.Hour)
+	require.NoError(t, s.RetireCID("cid", "id", until))
+	assert.ErrorIs(t, s.RetireCID("cid", "other", until), storage.ErrAlreadyExists, "RetireCID must return ErrAlreadyExists for a CID that is already retired")
+
+	retired, ok := s.GetRetiredCID("cid")
+	require.True(t, ok)
+	assert.Equal(t, "cid", retired.CID)
+	assert.Equal(t, "id", retired.ID, "RetireCID must not overwrite an existing retired CID")
+	assert.True(t, until.Equal(retired.Until), "GetRetiredCID must return the end of the grace period (expected %s, got %s)", until, retired.Until)
+
+	// retired CIDs are returned even once their grace period has ended
+	require.NoError(t, s.RetireCID("expired", "id", time.Now().Add(-time.Hour)))
+	_, ok = s.GetRetiredCID("expired")
+	assert.True(t, ok, "GetRetiredCID must return retired CIDs whose grace period has ended")
+
+	require.NoError(t, s.RetireCID("another", "other", until))
+
+	var paged []string
+	after := ""
+	for {
+		page, err := s.ListRetiredCIDs(after, 2)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page), 2, "ListRetiredCIDs must not return more than limit retired CIDs")
+		if len(page) == 0 {
+			break
+		}
+		for _, r := range page {
+			paged = append(paged, r.CID)
+		}
+		after = page[len(page)-1].CID
+	}
+	assert.Equal(t, []string{"another", "cid", "expired"}, paged, "paging through ListRetiredCIDs must return every retired CID exactly once")
+
+	require.NoError(t, s.RemoveRetiredCID("cid"))
+	_, ok = s.GetRetiredCID("cid")
+	assert.False(t, ok, "GetRetiredCID must not find a removed CID")
+	assert.ErrorIs(t, s.RemoveRetiredCID("cid"), storage.ErrNotFound)
+}
+
+// testAllowedDomains checks the error semantics of SetAllowedDomains, GetAllowedDomains, and RemoveAllowedDomains
+func testAllowedDomains(t *testing.T, s storage.Storage) {
+	_, ok := s.GetAllowedDomains("id")
+	assert.False(t, ok, "GetAllowedDomains must not find an ID whose allowed domains were never set")
+	assert.ErrorIs(t, s.RemoveAllowedDomains("id"), storage.ErrNotFound, "RemoveAllowedDomains must return ErrNotFound for an ID whose allowed domains were never set")
+
+	domains := []string{"example.com", "*.example.com"}
+	require.NoError(t, s.SetAllowedDomains("id", domains))
+	domains[0] = "modified.com"
+
+	allowed, ok := s.GetAllowedDomains("id")
+	require.True(t, ok)
+	assert.ElementsMatch(t, []string{"example.com", "*.example.com"}, allowed, "SetAllowedDomains must not retain the given slice")
+
+	require.NoError(t, s.SetAllowedDomains("id", []string{"example.org"}))
+	allowed, ok = s.GetAllowedDomains("id")
+	require.True(t, ok)
+	assert.Equal(t, []string{"example.org"}, allowed, "SetAllowedDomains must replace the allowed domains")
+
+	_, ok = s.GetAllowedDomains("other")
+	assert.False(t, ok, "allowed domains must be isolated by ID")
+
+	require.NoError(t, s.RemoveAllowedDomains("id"))
+	_, ok = s.GetAllowedDomains("id")
+	assert.False(t, ok)
+	assert.ErrorIs(t, s.RemoveAllowedDomains("id"), storage.ErrNotFound)
+}
+
+// testHashedLabel checks the semantics of SetHashedLabel and GetHashedLabel
+func testHashedLabel(t *testing.T, s storage.Storage) {
+	domain := strings.Repeat("a", 63) + ".example.com"
+	label := utils.HashedLabel(domain)
+
+	_, ok := s.GetHashedLabel(label)
+	assert.False(t, ok, "GetHashedLabel must not find a hashed label that was never set")
+
+	require.NoError(t, s.SetHashedLabel(label, domain))
+	assert.NoError(t, s.SetHashedLabel(label, domain), "SetHashedLabel must not return an error for a hashed label that is already set")
+
+	stored, ok := s.GetHashedLabel(label)
+	require.True(t, ok)
+	assert.Equal(t, domain, stored)
+
+	_, ok = s.GetHashedLabel(utils.HashedLabel("other.com"))
+	assert.False(t, ok, "hashed labels must be isolated by label")
+}
+
+// testDNSChallenge checks the error semantics of SetDNSChallenge, GetDNSChallenges, and RemoveDNSChallenge,
+// as well as the ability to store multiple challenges for a single CID and label
+func testDNSChallenge(t *testing.T, s storage.Storage) {
+	_, ok := s.GetDNSChallenges("cid", "example-com")
+	assert.False(t, ok, "GetDNSChallenges must not find challenges that were never set")
+	assert.ErrorIs(t, s.RemoveDNSChallenge("cid", "example-com", "first"), storage.ErrNotFound, "RemoveDNSChallenge must return ErrNotFound for a challenge that was never set")
+
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "first"))
+	assert.ErrorIs(t, s.SetDNSChallenge("cid", "example-com", "first"), storage.ErrAlreadyExists, "SetDNSChallenge must return ErrAlreadyExists for a challenge that is already set")
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "second"), "SetDNSChallenge must allow multiple challenges for the same CID and label")
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "third"))
+
+	challenges, ok := s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first", "second", "third"}, challenges, "GetDNSChallenges must return challenges in the order they were set")
+
+	challenges[0] = "modified"
+	challenges, ok = s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first", "second", "third"}, challenges, "modifying the challenges returned by GetDNSChallenges must not modify the storage")
+
+	require.NoError(t, s.RemoveDNSChallenge("cid", "example-com", "second"))
+	assert.ErrorIs(t, s.RemoveDNSChallenge("cid", "example-com", "second"), storage.ErrNotFound, "RemoveDNSChallenge must return ErrNotFound for a removed challenge")
+
+	challenges, ok = s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first", "third"}, challenges, "RemoveDNSChallenge must only remove the given challenge")
+
+	require.NoError(t, s.RemoveDNSChallenge("cid", "example-com", "first"))
+	require.NoError(t, s.RemoveDNSChallenge("cid", "example-com", "third"))
+	_, ok = s.GetDNSChallenges("cid", "example-com")
+	assert.False(t, ok, "GetDNSChallenges must not find challenges once they have all been removed")
+
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "first"), "SetDNSChallenge must succeed for a removed challenge")
+}
+
+// testDNSChallengeLabels checks that the storage keeps labels exactly as given, so that labels
+// which only differ by their hyphens (such as the labels for sub-example.com and sub.example.com)
+// never refer to the same set of challenges
+func testDNSChallengeLabels(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.SetDNSChallenge("cid", "sub--example-com", "first"))
+	require.NoError(t, s.SetDNSChallenge("cid", "sub-example-com", "first"), "SetDNSChallenge must not normalize the given label")
+
+	challenges, ok := s.GetDNSChallenges("cid", "sub--example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first"}, challenges)
+
+	require.NoError(t, s.RemoveDNSChallenge("cid", "sub-example-com", "first"))
+	_, ok = s.GetDNSChallenges("cid", "sub-example-com")
+	assert.False(t, ok)
+
+	challenges, ok = s.GetDNSChallenges("cid", "sub--example-com")
+	require.True(t, ok, "RemoveDNSChallenge must only remove challenges for the given label")
+	assert.Equal(t, []string{"first"}, challenges)
+
+	listed, err := s.ListDNSChallenges(storage.DNSChallenge{}, 0)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "sub--example-com", listed[0].Label)
+}
+
+// testDNSChallengeIsolation checks that challenges for one CID or label are never returned for another CID or label
+func testDNSChallengeIsolation(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.SetDNSChallenge("first", "example-com", "first-challenge"))
+	require.NoError(t, s.SetDNSChallenge("second", "example-com", "second-challenge"))
+	require.NoError(t, s.SetDNSChallenge("first", "example-org", "third-challenge"))
+	require.NoError(t, s.SetDNSChallenge("second", "example-com", "first-challenge"), "the same challenge must be allowed for different CIDs")
+
+	challenges, ok := s.GetDNSChallenges("first", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"first-challenge"}, challenges)
+
+	challenges, ok = s.GetDNSChallenges("second", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"second-challenge", "first-challenge"}, challenges)
+
+	challenges, ok = s.GetDNSChallenges("first", "example-org")
+	require.True(t, ok)
+	assert.Equal(t, []string{"third-challenge"}, challenges)
+
+	require.NoError(t, s.RemoveDNSChallenge("first", "example-com", "first-challenge"))
+	challenges, ok = s.GetDNSChallenges("second", "example-com")
+	require.True(t, ok, "RemoveDNSChallenge must not remove challenges for other CIDs")
+	assert.Equal(t, []string{"second-challenge", "first-challenge"}, challenges)
+}
+
+// testExpireDNSChallenges checks that ExpireDNSChallenges only removes the challenges that were set before the given time
+func testExpireDNSChallenges(t *testing.T, s storage.Storage) {
+	expired, err := s.ExpireDNSChallenges(time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, expired, "ExpireDNSChallenges must not expire anything when there are no challenges")
+
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "stale"))
+	require.NoError(t, s.SetDNSChallenge("other", "example-org", "stale"))
+
+	// some clocks have a coarse resolution, so wait until the cutoff is strictly after the stale challenges were set
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "fresh"))
+
+	expired, err = s.ExpireDNSChallenges(cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, 2, expired, "ExpireDNSChallenges must return the number of challenges that were removed")
+
+	challenges, ok := s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok, "ExpireDNSChallenges must not remove challenges that were set after the given time")
+	assert.Equal(t, []string{"fresh"}, challenges)
+
+	_, ok = s.GetDNSChallenges("other", "example-org")
+	assert.False(t, ok, "ExpireDNSChallenges must remove every challenge that was set before the given time")
+	assert.ErrorIs(t, s.RemoveDNSChallenge("other", "example-org", "stale"), storage.ErrNotFound)
+
+	// expired challenges must be able to be set again
+	require.NoError(t, s.SetDNSChallenge("other", "example-org", "stale"))
+}
+
+// testListDNSChallenges checks that ListDNSChallenges pages through every challenge in order
+func testListDNSChallenges(t *testing.T, s storage.Storage) {
+	challenges, err := s.ListDNSChallenges(storage.DNSChallenge{}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, challenges)
+
+	start := time.Now()
+	require.NoError(t, s.SetDNSChallenge("cid-b", "example-com", "second"))
+	require.NoError(t, s.SetDNSChallenge("cid-b", "example-com", "first"))
+	require.NoError(t, s.SetDNSChallenge("cid-a", "example-org", "only"))
+	require.NoError(t, s.SetDNSChallenge("cid-b", "a-example-com", "only"))
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "only"))
+	require.NoError(t, s.SetDNSChallenge("cid-b", "example", "only"))
+
+	expected := []storage.DNSChallenge{
+		{CID: "cid", Label: "example-com", Challenge: "only"},
+		{CID: "cid-a", Label: "example-org", Challenge: "only"},
+		{CID: "cid-b", Label: "a-example-com", Challenge: "only"},
+		{CID: "cid-b", Label: "example", Challenge: "only"},
+		{CID: "cid-b", Label: "example-com", Challenge: "first"},
+		{CID: "cid-b", Label: "example-com", Challenge: "second"},
+	}
+
+	challenges, err = s.ListDNSChallenges(storage.DNSChallenge{}, 0)
+	require.NoError(t, err)
+	require.Len(t, challenges, len(expected), "ListDNSChallenges must return every challenge when limit is zero")
+	for i, challenge := range challenges {
+		assert.False(t, challenge.CreatedAt.Before(start.Add(-time.Second)), "ListDNSChallenges must return when each challenge was set")
+		challenges[i].CreatedAt = time.Time{}
+	}
+	assert.Equal(t, expected, challenges, "ListDNSChallenges must return labels ordered by CID, label, and challenge")
+
+	var paged []storage.DNSChallenge
+	var after storage.DNSChallenge
+	for {
+		page, err := s.ListDNSChallenges(after, 3)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page), 3, "ListDNSChallenges must not return more than limit challenges")
+		if len(page) == 0 {
+			break
+		}
+		after = page[len(page)-1]
+		for _, challenge := range page {
+			challenge.CreatedAt = time.Time{}
+			paged = append(paged, challenge)
+		}
+	}
+	assert.Equal(t, expected, paged, "paging through ListDNSChallenges must return every challenge exactly once")
+}
+
+// testConcurrentSetCID checks that exactly one of many concurrent SetCID calls for the same ID succeeds
+func testConcurrentSetCID(t *testing.T, s storage.Storage) {
+	var wg sync.WaitGroup
+	errs := make(chan error, Concurrency)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.SetCID("id", fmt.Sprintf("cid-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+	}
+	assert.Equal(t, 1, succeeded, "exactly one concurrent SetCID call must succeed")
+}
+
+// testConcurrentDNSChallenges checks that concurrent SetDNSChallenge and RemoveDNSChallenge calls
+// for the same CID and label do not lose or duplicate any challenges
+func testConcurrentDNSChallenges(t *testing.T, s storage.Storage) {
+	var wg sync.WaitGroup
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, s.SetDNSChallenge("cid", "example-com", fmt.Sprintf("challenge-%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	challenges, ok := s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Len(t, challenges, Concurrency, "no concurrently set challenges may be lost")
+
+	for i := 0; i < Concurrency; i += 2 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, s.RemoveDNSChallenge("cid", "example-com", fmt.Sprintf("challenge-%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	challenges, ok = s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Len(t, challenges, Concurrency/2, "no challenges may be removed other than the ones that were concurrently removed")
+	for i := 1; i < Concurrency; i += 2 {
+		assert.Contains(t, challenges, fmt.Sprintf("challenge-%d", i))
+	}
+}
@@ -0,0 +1,155 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package sweeper periodically removes stale DNS challenges from storage, such as
+// challenges left behind by a process that crashed before cleaning them up, along
+// with retired CIDs whose grace period has ended
+package sweeper
+
+import (
+	"context"
+	"errors"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/loopholelabs/certifier/pkg/storage"
+	"github.com/loopholelabs/logging"
+	"sync"
+	"time"
+)
+
+// PageSize is the number of retired CIDs that are listed at a time when sweeping
+const PageSize = 100
+
+// Sweeper expires DNS challenges that have been in storage for longer than the configured
+// DNSChallengeTTL and removes retired CIDs whose grace period has ended, once every DNSChallengeSweepInterval
+type Sweeper struct {
+	// options contains the options used to configure this instance of Sweeper
+	options *options.Options
+
+	// ctx is canceled when the Sweeper is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// New creates a new instance of Sweeper given a set of configuration options,
+// which does not sweep in the background until Start is called
+func New(opts ...options.Option) *Sweeper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Sweeper{
+		options: options.LoadOptions(opts...),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Start starts sweeping in the background until Stop is called
+//
+// Calling Start more than once, or after the Sweeper has been stopped, does nothing.
+func (s *Sweeper) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+	s.logger().Debugf("starting DNS challenge sweeper\n")
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Sweep expires any DNS challenges that have been in storage for longer than the configured DNSChallengeTTL,
+// and removes any retired CIDs whose grace period has ended, returning the number of each that were removed
+func (s *Sweeper) Sweep(ctx context.Context) (challenges int, cids int, err error) {
+	now := time.Now()
+	challenges, err = storage.ExpireDNSChallengesContext(ctx, s.storage(), now.Add(-s.options.DNSChallengeTTL))
+	if err != nil {
+		return
+	}
+
+	after := ""
+	for {
+		var retired []storage.RetiredCID
+		retired, err = storage.ListRetiredCIDsContext(ctx, s.storage(), after, PageSize)
+		if err != nil || len(retired) == 0 {
+			return
+		}
+		for _, r := range retired {
+			if now.Before(r.Until) {
+				continue
+			}
+			err = storage.RemoveRetiredCIDContext(ctx, s.storage(), r.CID)
+			if errors.Is(err, storage.ErrNotFound) {
+				// another Certifier replica removed it first
+				continue
+			}
+			if err != nil {
+				return
+			}
+			cids++
+		}
+		after = retired[len(retired)-1].CID
+	}
+}
+
+// Stop stops the Sweeper, waiting for any sweep that is in progress to finish
+func (s *Sweeper) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.logger().Infof("stopping DNS challenge sweeper\n")
+	s.cancel()
+	s.wg.Wait()
+}
+
+// run sweeps once every DNSChallengeSweepInterval until the Sweeper is stopped
+func (s *Sweeper) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.options.DNSChallengeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			challenges, cids, err := s.Sweep(s.ctx)
+			if challenges > 0 || cids > 0 {
+				s.logger().Infof("expired %d stale DNS challenges and %d retired CIDs\n", challenges, cids)
+			}
+			if err != nil && s.ctx.Err() == nil {
+				s.logger().Errorf("unable to expire stale DNS challenges and retired CIDs: %s\n", err)
+			}
+		}
+	}
+}
+
+// logger returns the logging interface for this instance of Sweeper
+func (s *Sweeper) logger() logging.Logger {
+	return s.options.Logger
+}
+
+// storage returns the storage interface for this instance of Sweeper
+func (s *Sweeper) storage() storage.Storage {
+	return s.options.Storage
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sweeper
+
+import (
+	"context"
+	"github.com/loopholelabs/certifier/internal/memory"
+	"github.com/loopholelabs/certifier/pkg/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSweeper(t *testing.T) {
+	t.Parallel()
+
+	s := memory.New()
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "stale"))
+
+	sw := New(options.WithStorage(s), options.WithDNSChallengeTTL(time.Millisecond), options.WithDNSChallengeSweepInterval(time.Millisecond))
+	t.Cleanup(sw.Stop)
+
+	// nothing is swept until the Sweeper is started
+	time.Sleep(time.Millisecond * 50)
+	_, ok := s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+
+	sw.Start()
+	sw.Start()
+
+	assert.Eventually(t, func() bool {
+		_, ok := s.GetDNSChallenges("cid", "example-com")
+		return !ok
+	}, time.Second, time.Millisecond)
+
+	// the expired challenge must be able to be presented again
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "stale"))
+}
+
+func TestSweep(t *testing.T) {
+	t.Parallel()
+
+	s := memory.New()
+	require.NoError(t, s.SetDNSChallenge("cid", "example-com", "fresh"))
+
+	sw := New(options.WithStorage(s), options.WithDNSChallengeTTL(time.Hour), options.WithDNSChallengeSweepInterval(time.Hour))
+	sw.Stop()
+	sw.Stop()
+	sw.Start()
+
+	require.NoError(t, s.RetireCID("expired", "id", time.Now().Add(-time.Second)))
+	require.NoError(t, s.RetireCID("grace", "id", time.Now().Add(time.Hour)))
+
+	challenges, cids, err := sw.Sweep(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, challenges)
+	assert.Equal(t, 1, cids)
+
+	_, ok := s.GetRetiredCID("expired")
+	assert.False(t, ok)
+	_, ok = s.GetRetiredCID("grace")
+	assert.True(t, ok)
+
+	fresh, ok := s.GetDNSChallenges("cid", "example-com")
+	require.True(t, ok)
+	assert.Equal(t, []string{"fresh"}, fresh)
+}
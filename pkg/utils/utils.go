@@ -17,9 +17,32 @@
 // Package utils contains a set of utility functions
 package utils
 
-import "strings"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// MaxLabelLength is the maximum length of a single DNS label
+	MaxLabelLength = 63
+
+	// MaxDomainLength is the maximum length of a domain, not including its trailing period
+	MaxDomainLength = 253
+
+	// HashedLabelPrefix is the prefix of the labels that EncodeDomain returns for domains whose encoded label
+	// would be longer than MaxLabelLength, which can never be produced by encoding a domain
+	HashedLabelPrefix = "h---"
+
+	// hashedLabelLength is the number of hexadecimal characters of the hash used in hashed labels
+	hashedLabelLength = 40
+)
 
 // NormalizeDomain replaces all the periods in a domain (example.com) with hyphens (example-com)
+//
+// Deprecated: NormalizeDomain is ambiguous, since different domains (such as a-b.com and a.b.com) normalize
+// to the same label. It is only used to support CNAME records created for earlier versions of Certifier,
+// and EncodeDomain should be used instead.
 func NormalizeDomain(domain string) string {
 	if domain == "" {
 		return ""
@@ -27,6 +50,125 @@ func NormalizeDomain(domain string) string {
 	return strings.ReplaceAll(domain, ".", "-")
 }
 
+// EncodeDomain encodes a domain as a single DNS label by lowercasing it, doubling all of its hyphens,
+// and then replacing all of its periods with hyphens (so a-b.example.com becomes a--b-example-com)
+//
+// Since the labels of a valid domain never start or end with a hyphen, the encoding is injective and can
+// be reversed using DecodeLabel. Domains without any hyphens are encoded to the same label as NormalizeDomain.
+//
+// If the encoded label would be longer than MaxLabelLength, the domain is instead encoded to a hashed label
+// (see HashedLabel), which is not reversible but is still unique to the domain.
+func EncodeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	label := strings.ReplaceAll(strings.ReplaceAll(domain, "-", "--"), ".", "-")
+	if len(label) > MaxLabelLength {
+		return HashedLabel(domain)
+	}
+	return label
+}
+
+// HashedLabel returns HashedLabelPrefix followed by the first 40 hexadecimal characters of the SHA-256 hash of the
+// lowercased domain, which is the label that EncodeDomain uses for domains that are too long to be encoded directly
+func HashedLabel(domain string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSuffix(domain, "."))))
+	return JoinStrings(HashedLabelPrefix, hex.EncodeToString(sum[:])[:hashedLabelLength])
+}
+
+// IsHashedLabel checks whether a label is of the form returned by HashedLabel
+func IsHashedLabel(label string) bool {
+	hash, ok := strings.CutPrefix(label, HashedLabelPrefix)
+	if !ok || len(hash) != hashedLabelLength {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+// ValidLabel checks whether a label could have been returned by EncodeDomain
+func ValidLabel(label string) bool {
+	if len(label) > MaxLabelLength {
+		return false
+	}
+	if IsHashedLabel(label) {
+		return true
+	}
+	_, ok := DecodeLabel(label)
+	return ok
+}
+
+// DecodeLabel reverses EncodeDomain, returning false if the label could not have been produced by EncodeDomain
+// (such as labels containing anything other than lowercase letters, digits, and hyphens) or if it is a hashed
+// label (which cannot be reversed)
+func DecodeLabel(label string) (string, bool) {
+	if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		if c := label[i]; (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return "", false
+		}
+		if label[i] != '-' {
+			b.WriteByte(label[i])
+			continue
+		}
+		if label[i+1] == '-' {
+			b.WriteByte('-')
+			i++
+			continue
+		}
+		b.WriteByte('.')
+	}
+	domain := b.String()
+	for _, l := range strings.Split(domain, ".") {
+		// labels that start or end with hyphens (such as the a- in a-.b) are not valid in domains
+		if strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return "", false
+		}
+	}
+	return domain, true
+}
+
+// ChallengeLabels returns the labels that the DNS-01 Challenges for a domain are stored under, starting with
+// its EncodeDomain label, which are the labels that its _acme-challenge CNAME record may point at
+//
+// Wildcard domains use the labels of their base domain. If legacy is true and the domain contains hyphens,
+// the ambiguous NormalizeDomain label is also returned (as long as it is a valid label), so that CNAME records
+// created for earlier versions of Certifier keep working.
+func ChallengeLabels(domain string, legacy bool) []string {
+	domain = strings.ToLower(strings.TrimSuffix(TrimWildcard(domain), "."))
+	labels := []string{EncodeDomain(domain)}
+	if normalized := NormalizeDomain(domain); legacy && normalized != labels[0] && len(normalized) <= MaxLabelLength {
+		labels = append(labels, normalized)
+	}
+	return labels
+}
+
+// TrimWildcard removes the wildcard label from a wildcard domain (*.example.com becomes example.com),
+// which is the domain that the DNS-01 Challenge for a wildcard domain is performed against
+func TrimWildcard(domain string) string {
+	return strings.TrimPrefix(domain, "*.")
+}
+
+// DomainAllowed checks whether a domain is matched by any of the given patterns, where a pattern is either
+// a domain (example.com), which only matches that exact domain, or a wildcard domain (*.example.com),
+// which matches every subdomain of its base domain (including *.example.com itself) but not the base domain
+//
+// Domains and patterns are compared case-insensitively, ignoring any trailing periods
+func DomainAllowed(patterns []string, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if pattern == domain {
+			return true
+		}
+		if base := TrimWildcard(pattern); base != pattern && strings.HasSuffix(domain, JoinStrings(".", base)) {
+			return true
+		}
+	}
+	return false
+}
+
 // JoinStrings combines multiple strings together using the strings.Builder struct
 func JoinStrings(s ...string) string {
 	var b strings.Builder
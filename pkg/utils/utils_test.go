@@ -0,0 +1,189 @@
+/*
+	Copyright 2022 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDomain(t *testing.T) {
+	t.Parallel()
+
+	for domain, label := range map[string]string{
+		"example.com":             "example-com",
+		"a.b.com":                 "a-b-com",
+		"a-b.com":                 "a--b-com",
+		"a--b.com":                "a----b-com",
+		"a-b.c-d.com":             "a--b-c--d-com",
+		"xn--bcher-kva.example":   "xn----bcher--kva-example",
+		"Example.COM":             "example-com",
+		"example.com.":            "example-com",
+		"Sub.Example-Domain.COM.": "sub-example--domain-com",
+	} {
+		assert.Equal(t, label, EncodeDomain(domain), domain)
+
+		decoded, ok := DecodeLabel(label)
+		assert.True(t, ok, label)
+		assert.Equal(t, strings.ToLower(strings.TrimSuffix(domain, ".")), decoded, label)
+	}
+}
+
+func TestEncodeDomainInjective(t *testing.T) {
+	t.Parallel()
+
+	// these domains all normalize to the same label, but must be encoded to different labels
+	domains := []string{"a.b.c.com", "a-b.c.com", "a.b-c.com", "a-b-c.com", "a--b.c.com", "a.b--c.com", "a-b--c.com", "a--b-c.com"}
+	labels := make(map[string]string, len(domains))
+	for _, domain := range domains {
+		label := EncodeDomain(domain)
+		if other, ok := labels[label]; ok {
+			t.Errorf("%s and %s are both encoded to %s", domain, other, label)
+		}
+		labels[label] = domain
+
+		decoded, ok := DecodeLabel(label)
+		assert.True(t, ok, label)
+		assert.Equal(t, domain, decoded, label)
+	}
+}
+
+func TestDecodeLabel(t *testing.T) {
+	t.Parallel()
+
+	for _, label := range []string{
+		"",
+		"-example-com",
+		"example-com-",
+		"a---b-com",
+		"a-----b-com",
+		"a-b---com",
+		"a_b-com",
+		"a b-com",
+		"Example-com",
+		"a.b-com",
+	} {
+		_, ok := DecodeLabel(label)
+		assert.False(t, ok, label)
+	}
+}
+
+func TestChallengeLabels(t *testing.T) {
+	t.Parallel()
+
+	// the encoded label is longer than MaxLabelLength, but the legacy label is not
+	hyphens := strings.Repeat("a-", 20) + "a.com"
+
+	for _, c := range []struct {
+		domain string
+		legacy bool
+		labels []string
+	}{
+		{domain: "example.com", labels: []string{"example-com"}},
+		{domain: "example.com", legacy: true, labels: []string{"example-com"}},
+		{domain: "*.example.com", labels: []string{"example-com"}},
+		{domain: "*.Example.COM.", legacy: true, labels: []string{"example-com"}},
+		{domain: "a-b.com", labels: []string{"a--b-com"}},
+		{domain: "a-b.com", legacy: true, labels: []string{"a--b-com", "a-b-com"}},
+		{domain: "*.a-b.com", legacy: true, labels: []string{"a--b-com", "a-b-com"}},
+		{domain: hyphens, labels: []string{HashedLabel(hyphens)}},
+		{domain: hyphens, legacy: true, labels: []string{HashedLabel(hyphens), NormalizeDomain(hyphens)}},
+		{domain: strings.Repeat("a-", 40) + "a.com", legacy: true, labels: []string{HashedLabel(strings.Repeat("a-", 40) + "a.com")}},
+	} {
+		assert.Equal(t, c.labels, ChallengeLabels(c.domain, c.legacy), "%s (legacy %t)", c.domain, c.legacy)
+	}
+}
+
+func TestHashedLabel(t *testing.T) {
+	t.Parallel()
+
+	plain := strings.Repeat("a", MaxLabelLength-len(".com")) + ".com"
+	require.Len(t, EncodeDomain(plain), MaxLabelLength)
+	assert.Equal(t, strings.TrimSuffix(plain, ".com")+"-com", EncodeDomain(plain))
+	assert.False(t, IsHashedLabel(EncodeDomain(plain)))
+
+	hashed := "a" + plain
+	assert.Equal(t, HashedLabel(hashed), EncodeDomain(hashed))
+	assert.True(t, IsHashedLabel(EncodeDomain(hashed)))
+	assert.Len(t, EncodeDomain(hashed), len(HashedLabelPrefix)+hashedLabelLength)
+
+	// the hash must not depend on the case or a trailing dot
+	assert.Equal(t, HashedLabel(hashed), HashedLabel(strings.ToUpper(hashed)))
+	assert.Equal(t, HashedLabel(hashed), HashedLabel(hashed+"."))
+	assert.Equal(t, EncodeDomain(hashed), EncodeDomain(strings.ToUpper(hashed)+"."))
+	assert.NotEqual(t, HashedLabel(hashed), HashedLabel(plain))
+}
+
+func TestIsHashedLabel(t *testing.T) {
+	t.Parallel()
+
+	digest := strings.TrimPrefix(HashedLabel("example.com"), HashedLabelPrefix)
+	require.Len(t, digest, hashedLabelLength)
+
+	assert.True(t, IsHashedLabel(HashedLabelPrefix+digest))
+
+	for _, label := range []string{
+		"",
+		HashedLabelPrefix,
+		digest,
+		HashedLabelPrefix + digest[1:],
+		HashedLabelPrefix + digest + "0",
+		HashedLabelPrefix + strings.ToUpper(digest),
+		HashedLabelPrefix + strings.Repeat("g", hashedLabelLength),
+		"h--" + digest,
+		// legitimately encoded domains starting with "h--" are never mistaken for hashed labels
+		EncodeDomain("h--" + digest[1:] + ".com"),
+		EncodeDomain("h--" + digest),
+		EncodeDomain("h." + digest),
+		EncodeDomain("h-" + digest),
+	} {
+		assert.False(t, IsHashedLabel(label), label)
+	}
+}
+
+func TestValidLabel(t *testing.T) {
+	t.Parallel()
+
+	for _, label := range []string{
+		"example-com",
+		"a--b-com",
+		"xn----bcher--kva-example",
+		EncodeDomain(strings.Repeat("a", MaxLabelLength) + ".com"),
+		HashedLabel("example.com"),
+	} {
+		assert.True(t, ValidLabel(label), label)
+	}
+
+	for _, label := range []string{
+		"",
+		"a_b-com",
+		"a b-com",
+		"a.b-com",
+		"a*-com",
+		"é-com",
+		"Example-com",
+		"-example-com",
+		"example-com-",
+		"a---b-com",
+		strings.Repeat("a", MaxLabelLength+1),
+		HashedLabelPrefix + "example-com",
+	} {
+		assert.False(t, ValidLabel(label), label)
+	}
+}